@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/contextualist/acp/pkg/config"
+	"github.com/contextualist/acp/pkg/roster"
+)
+
+func runDevices(args []string) error {
+	fs := flag.NewFlagSet("devices", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage:\n  acp devices                 list the devices sharing the config\n  acp devices approve <name>  let in a device turned away for not being on the roster\n  acp devices revoke <name>   remove a device from the group for good\n")
+	}
+	_ = fs.Parse(args)
+
+	g, err := roster.Open(config.Dir())
+	if err != nil {
+		return err
+	}
+	switch fs.Arg(0) {
+	case "":
+		r := g.Roster()
+		for _, d := range r.Devices {
+			fmt.Printf("  %-20s %s%s\n", d.Name, d.Fingerprint(), tern(d.Key.Equal(g.Self.Key), "  (this device)", ""))
+		}
+		for _, d := range r.Revoked {
+			fmt.Printf("  %-20s %s  (revoked)\n", d.Name, d.Fingerprint())
+		}
+		for _, d := range r.Pending {
+			fmt.Printf("  %-20s %s  (turned away, see acp devices approve)\n", d.Name, d.Fingerprint())
+		}
+		return nil
+	case "approve":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return fmt.Errorf("expect the name of one device to approve")
+		}
+		if err = g.Approve(fs.Arg(1)); err != nil {
+			return err
+		}
+		fmt.Printf("Approved %s. It joins the group on its next transfer with this device.\n", fs.Arg(1))
+		return nil
+	case "revoke":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return fmt.Errorf("expect the name of one device to revoke")
+		}
+		if err = g.Revoke(fs.Arg(1)); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked %s. The other devices learn about it as they transfer with this one, or with each other.\n", fs.Arg(1))
+		return nil
+	}
+	fs.Usage()
+	return fmt.Errorf("unknown command %q", fs.Arg(0))
+}
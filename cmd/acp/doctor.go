@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/contextualist/acp/pkg/config"
+	"github.com/contextualist/acp/pkg/pnet"
+	tsapi "github.com/contextualist/acp/pkg/tailscale"
+)
+
+const doctorTimeout = 10 * time.Second
+
+// diagnosis collects the findings of `acp doctor` for the final verdict
+type diagnosis struct {
+	serverOK     bool
+	proxied      bool
+	behindNAT    bool
+	tcpPreserved bool   // whether the NAT keeps the local TCP port as the public one
+	udpMapping   string // "endpoint-independent", "endpoint-dependent" or ""
+	portMapping  bool
+	tailscale    bool
+	ipv6         bool
+}
+
+func runDoctor(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	verbose := fs.Bool("debug", false, "Print the details of each check")
+	_ = fs.Parse(args)
+
+	conf := config.MustGetConfig()
+	conf.ApplyDefault()
+	doctorLog = doctorLogger{*verbose}
+	pnet.SetLogger(doctorLog)
+
+	d := diagnosis{behindNAT: true} // until proven otherwise
+	checkProxy(conf, &d)
+	checkServer(conf, &d)
+	if !d.proxied { // direct connections are ruled out anyway
+		if d.serverOK {
+			checkTCPNAT(conf, &d)
+		}
+		checkUDPNAT(conf, &d)
+		checkPortMapping(&d)
+	}
+	checkTailscale(&d)
+	if !d.proxied {
+		checkIPv6(conf, &d)
+	}
+	fmt.Println()
+	printVerdict(conf, &d)
+	return nil
+}
+
+func checkProxy(conf *config.Config, d *diagnosis) {
+	proxy, err := pnet.ProxyFor(conf.Proxy, conf.Server)
+	if err != nil {
+		report(false, "%v", err)
+		return
+	}
+	if proxy != nil {
+		pnet.SetProxy(proxy)
+		d.proxied = true
+		report(true, "using proxy %s; hole punching is skipped behind a proxy", proxy.Redacted())
+	}
+}
+
+func checkServer(conf *config.Config, d *diagnosis) {
+	client := &http.Client{
+		Timeout:   doctorTimeout,
+		Transport: &http.Transport{DialContext: pnet.DialUpstream},
+	}
+	start := time.Now()
+	resp, err := client.Get(conf.Server + "/get")
+	if err != nil {
+		report(false, "rendezvous server %s is unreachable: %v", conf.Server, err)
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		report(false, "rendezvous server %s responded with %s", conf.Server, resp.Status)
+		return
+	}
+	d.serverOK = true
+	report(true, "rendezvous server %s is reachable (%v)", conf.Server, time.Since(start).Round(time.Millisecond))
+}
+
+// checkTCPNAT exchanges info with ourselves via the rendezvous server from two local ports,
+// so that the server reveals how the NAT (if any) maps them
+func checkTCPNAT(conf *config.Config, d *diagnosis) {
+	var ports [2]int
+	for i := range ports {
+		p, err := pnet.FreePort(conf.UseIPv6)
+		if err != nil {
+			report(false, "TCP NAT check failed: %v", err)
+			return
+		}
+		ports[i] = p
+	}
+	pub, err := selfExchange(conf, ports)
+	if err != nil {
+		report(false, "TCP NAT check failed: %v", err)
+		return
+	}
+	local, _ := pnet.OutboundIP(conf.UseIPv6)
+	d.behindNAT = pub[0].Addr() != local
+	d.tcpPreserved = pub[0].Port() == uint16(ports[0]) && pub[1].Port() == uint16(ports[1])
+	switch {
+	case !d.behindNAT:
+		report(true, "public IP %v is on this machine, no NAT for TCP", pub[0].Addr())
+	case d.tcpPreserved:
+		report(true, "behind NAT (public IP %v), TCP ports are preserved", pub[0].Addr())
+	default:
+		report(false, "behind NAT (public IP %v), TCP ports are rewritten (local :%d -> public :%d, local :%d -> public :%d)",
+			pub[0].Addr(), ports[0], pub[0].Port(), ports[1], pub[1].Port())
+	}
+}
+
+func selfExchange(conf *config.Config, ports [2]int) (pub [2]netip.AddrPort, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	// Random, as the channel is unauthenticated and the config ID is not to be seen by the server
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	chanName := "doctor-" + hex.EncodeToString(nonce)
+	type result struct {
+		info *pnet.PeerInfo
+		err  error
+	}
+	chResult := [2]chan result{make(chan result, 1), make(chan result, 1)}
+	for i, port := range ports {
+		go func() {
+			info, err := pnet.ExchangeConnInfo(ctx, conf.Server+"/v2/exchange", &pnet.SelfInfo{ChanName: chanName}, port, conf.UseIPv6)
+			chResult[i] <- result{info, err}
+		}()
+	}
+	for i := range ports {
+		r := <-chResult[i]
+		if r.err != nil {
+			return pub, r.err
+		}
+		// The one from ports[i] sees the other's public address
+		if pub[1-i], err = netip.ParseAddrPort(r.info.PeerAddrs[0].PubAddr); err != nil {
+			return pub, fmt.Errorf("unexpected reply from server: %w", err)
+		}
+		pub[1-i] = netip.AddrPortFrom(pub[1-i].Addr().Unmap(), pub[1-i].Port())
+	}
+	return pub, nil
+}
+
+// checkUDPNAT asks two STUN servers for the public endpoint of the same UDP socket.
+// An endpoint-independent mapping gives the same answer, while a symmetric NAT does not.
+func checkUDPNAT(conf *config.Config, d *diagnosis) {
+	pconn, err := pnet.ListenPacket(context.Background(), tern(conf.UseIPv6, "udp6", "udp4"), ":0")
+	if err != nil {
+		report(false, "UDP NAT check failed: %v", err)
+		return
+	}
+	defer func() { _ = pconn.Close() }()
+	var mapped []netip.AddrPort
+	for _, server := range conf.STUNServers {
+		ap, err := pnet.STUNMappedAddr(context.Background(), pconn, server, conf.UseIPv6)
+		if err != nil {
+			doctorLog.Debugf("%v", err)
+			continue
+		}
+		mapped = append(mapped, ap)
+	}
+	switch {
+	case len(mapped) < 2:
+		report(false, "UDP NAT check needs 2 responding STUN servers, got %d", len(mapped))
+	case mapped[0] == mapped[1]:
+		d.udpMapping = "endpoint-independent"
+		report(true, "UDP mapping is endpoint-independent (%v), good for quic_punch", mapped[0])
+	default:
+		d.udpMapping = "endpoint-dependent"
+		report(false, "UDP mapping is endpoint-dependent (symmetric NAT): %v vs %v", mapped[0], mapped[1])
+	}
+}
+
+func checkPortMapping(d *diagnosis) {
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	proto, err := pnet.DiscoverPortMapper(ctx)
+	if err != nil {
+		report(false, "no port mapping service found on the router: %v", err)
+		return
+	}
+	d.portMapping = true
+	report(true, "router supports port mapping via %s", proto)
+}
+
+func checkTailscale(d *diagnosis) {
+	addrs, _, err := tsapi.Interface()
+	if err != nil || len(addrs) == 0 {
+		report(false, "Tailscale network interface not found")
+		return
+	}
+	if bin, err := tsapi.Path(); err == nil {
+		cli := &tsapi.TSCli{Prefix: []string{bin}}
+		ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+		defer cancel()
+		if _, err = cli.RunStatus(ctx); err != nil {
+			report(false, "Tailscale interface found at %v, but status check failed: %v", addrs[0], err)
+			return
+		}
+	}
+	d.tailscale = true
+	report(true, "Tailscale is up at %v", addrs[0])
+}
+
+func checkIPv6(conf *config.Config, d *diagnosis) {
+	ip, err := pnet.OutboundIP(true)
+	if err != nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		report(false, "no global IPv6 address")
+		return
+	}
+	client := &http.Client{
+		Timeout: doctorTimeout,
+		Transport: &http.Transport{DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "tcp6", addr)
+		}},
+	}
+	resp, err := client.Get(conf.Server + "/get")
+	if err != nil {
+		report(false, "global IPv6 address %v, but the server is unreachable over IPv6: %v", ip, err)
+		return
+	}
+	_ = resp.Body.Close()
+	d.ipv6 = true
+	report(true, "IPv6 works (%v)", ip)
+}
+
+func printVerdict(conf *config.Config, d *diagnosis) {
+	hasStrategy := func(s string) bool { return slices.Contains(conf.Strategy, s) }
+	var suggestions []string
+	if !d.serverOK {
+		suggestions = append(suggestions, "check your network (or proxy) settings; on a LAN, `acp --offline` works without the server")
+	}
+	p2pLikely := !d.proxied && (!d.behindNAT || d.tcpPreserved || d.udpMapping == "endpoint-independent" || d.portMapping)
+	if d.portMapping && !conf.UPnP {
+		suggestions = append(suggestions, `enable "upnp" in config`)
+	}
+	if d.udpMapping == "endpoint-independent" && !hasStrategy("quic_punch") {
+		suggestions = append(suggestions, `add "quic_punch" to strategy`)
+	}
+	if d.tailscale && !hasStrategy("tailscale") {
+		suggestions = append(suggestions, `add "tailscale" to strategy`)
+	}
+	if !p2pLikely && !hasStrategy("relay") {
+		suggestions = append(suggestions, `add "relay" to the end of strategy, with a self-hosted relay (see docs/advanced.md)`)
+	}
+	if d.ipv6 && !conf.UseIPv6 {
+		suggestions = append(suggestions, `IPv6 works here; if it also works on your other devices, set "ipv6" in config to avoid NAT altogether`)
+	}
+
+	switch {
+	case !d.serverOK:
+		fmt.Println("Verdict: cannot reach the rendezvous server")
+	case p2pLikely:
+		fmt.Println("Verdict: P2P connection is likely to work from this machine")
+	case d.tailscale || hasStrategy("relay"):
+		fmt.Println("Verdict: P2P connection is unlikely, but a fallback is available")
+	default:
+		fmt.Println("Verdict: P2P connection is unlikely, and there is no fallback")
+	}
+	for _, s := range suggestions {
+		fmt.Printf("  - %s\n", s)
+	}
+}
+
+func report(ok bool, format string, a ...any) {
+	fmt.Printf("%s %s\n", tern(ok, "[ok]", "[!!]"), fmt.Sprintf(format, a...))
+}
+
+type doctorLogger struct{ verbose bool }
+
+var doctorLog doctorLogger
+
+func (l doctorLogger) Infof(format string, a ...any) { l.Debugf(format, a...) }
+func (l doctorLogger) Debugf(format string, a ...any) {
+	if l.verbose {
+		fmt.Printf("     "+format+"\n", a...)
+	}
+}
+
+func tern[T any](t bool, a T, b T) T {
+	if t {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/contextualist/acp/pkg/config"
+	"github.com/contextualist/acp/pkg/pnet"
+	"github.com/contextualist/acp/pkg/stream"
+)
+
+// exchange obtains the peer's info via the rendezvous server and/or LAN discovery,
+// whichever comes first
+func exchange(ctx context.Context, conf *config.Config, sinfo *pnet.SelfInfo) (*pnet.PeerInfo, error) {
+	port := conf.Ports[0]
+	viaServer := func(ctx context.Context) (*pnet.PeerInfo, error) {
+		s := *sinfo
+		info, err := pnet.ExchangeConnInfo(ctx, conf.Server+"/v2/exchange", &s, port, conf.UseIPv6)
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			// The preferred IP family is only a preference; the candidates cover both families anyway
+			logger.Debugf("failed to reach the server over %s, falling back: %v", tern(conf.UseIPv6, "IPv6", "IPv4"), err)
+			s = *sinfo
+			// If this fails as well, the error from the preferred family is more telling
+			if info2, err2 := pnet.ExchangeConnInfo(ctx, conf.Server+"/v2/exchange", &s, port, !conf.UseIPv6); err2 == nil {
+				info, err = info2, nil
+			}
+		}
+		return info, err
+	}
+	if !conf.LAN && !*offline {
+		return viaServer(ctx)
+	}
+
+	psk, prev, err := conf.Keys()
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil { // as for the server
+		psk = prev
+	}
+	viaLAN := func(ctx context.Context) (*pnet.PeerInfo, error) {
+		s := *sinfo
+		return pnet.DiscoverLAN(ctx, &s, psk, port, conf.UseIPv6)
+	}
+	if *offline {
+		return viaLAN(ctx)
+	}
+	return race(ctx, viaServer, viaLAN)
+}
+
+var pickUpMu sync.Mutex
+
+// pickUpKey saves the new PSK handed over by a device of the group, unless this device is in a rotation already.
+// The previous PSK is kept for no longer than maxGrace, however long the peer asks for.
+func pickUpKey(conf *config.Config, r *stream.KeyRotation) {
+	pickUpMu.Lock() // as sessions might be set up concurrently
+	defer pickUpMu.Unlock()
+	now := time.Now().Unix()
+	if now >= r.Until || conf.PrevPSK != "" && now < conf.PrevPSKUntil {
+		return
+	}
+	r.Until = min(r.Until, time.Now().Add(maxGrace).Unix())
+	psk := base64.StdEncoding.EncodeToString(r.PSK)
+	if psk == conf.PSK {
+		return
+	}
+	stored, err := config.Rotate(psk, time.Unix(r.Until, 0))
+	if err != nil {
+		logger.Infof("failed to save the new PSK from the peer: %v", err)
+		return
+	}
+	conf.PSK, conf.PrevPSK, conf.PrevPSKUntil = stored.PSK, stored.PrevPSK, stored.PrevPSKUntil
+	logger.Infof("picked up the new PSK from the peer; the previous one expires at %s", time.Unix(r.Until, 0).Format(time.DateTime))
+}
+
+// pinPort replaces the placeholder port 0 with a concrete free port, since the port needs to be
+// known before the exchange: the peer might get our info from either the server or LAN, and the
+// candidates of both IP families as well as the mapped port are gathered beforehand
+func pinPort(conf *config.Config) (err error) {
+	if conf.Ports[0] != 0 {
+		return nil
+	}
+	if conf.Ports[0], err = pnet.FreePort(conf.UseIPv6); err != nil {
+		conf.Ports[0], err = pnet.FreePort(!conf.UseIPv6)
+	}
+	return
+}
+
+// setProxy routes the connections to the server and the relay through the proxy, if any
+func setProxy(conf *config.Config) error {
+	proxy, err := pnet.ProxyFor(conf.Proxy, conf.Server)
+	if err != nil || proxy == nil {
+		return err
+	}
+	logger.Infof("connecting via proxy %s", proxy.Redacted())
+	pnet.SetProxy(proxy)
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/contextualist/acp/pkg/config"
+	"github.com/contextualist/acp/pkg/pnet"
+	"github.com/contextualist/acp/pkg/roster"
+)
+
+const (
+	defaultInviteTimeout = 10 * time.Minute
+	maxInvitationLen     = 64 * 1024
+)
+
+// runInvite hands the config over to a new device that joins with the code, enrolling it in the roster
+func runInvite(args []string) error {
+	fs := flag.NewFlagSet("invite", flag.ExitOnError)
+	timeout := fs.Duration("timeout", defaultInviteTimeout, "How long the code stays valid")
+	_ = fs.Parse(args)
+
+	conf := config.MustGetConfig()
+	group, err := roster.Open(config.Dir())
+	if err != nil {
+		return err
+	}
+	export, _ := json.Marshal(conf.Export())
+	conf.ApplyDefault()
+	code := pnet.NewShareCode()
+	joinArgs := code
+	if conf.Server != config.DefaultServer {
+		joinArgs = fmt.Sprintf("--server %s %s", conf.Server, code)
+	}
+	fmt.Printf(`On the new device, run
+
+    acp join %s
+
+or, to install acp as well
+
+    curl -fsS %s/get | sh -s -- join %s
+
+The code is good for one device within %v.
+
+`, joinArgs, conf.Server, joinArgs, *timeout)
+
+	run(conf, session{
+		code:    code,
+		timeout: *timeout,
+		group:   group,
+		send: func(s io.WriteCloser, _ func(string, ...any)) error {
+			if _, err := s.Write(export); err != nil {
+				_ = s.Close()
+				return err
+			}
+			return s.Close()
+		},
+	})
+	if exitStatement != "" {
+		return errors.New(exitStatement)
+	}
+	fmt.Println("The new device has joined.")
+	return nil
+}
+
+// runJoin sets up this device with the config from a device running `acp invite`
+func runJoin(args []string) error {
+	fs := flag.NewFlagSet("join", flag.ExitOnError)
+	server := fs.String("server", "", "Rendezvous server of the inviting device, if not the default")
+	force := fs.Bool("force", false, "Replace the existing config of this device")
+	timeout := fs.Duration("timeout", defaultInviteTimeout, "How long to wait for the inviting device")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage:\n  acp join [options] <code>\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expect the code shown by `acp invite`")
+	}
+
+	conf := config.MustGetConfigOrEmpty()
+	if conf.PSK != "" && !*force {
+		return errors.New("acp is already set up on this device; use --force to replace its config")
+	}
+	if *server != "" {
+		conf.Server = *server
+	}
+	conf.ApplyDefault()
+	group, err := roster.Open(config.Dir())
+	if err != nil {
+		return err
+	}
+
+	var received []byte
+	run(conf, session{
+		code:    fs.Arg(0),
+		timeout: *timeout,
+		group:   group,
+		receive: func(s io.ReadCloser) (err error) {
+			defer func() { _ = s.Close() }()
+			received, err = io.ReadAll(io.LimitReader(s, maxInvitationLen))
+			return
+		},
+	})
+	if exitStatement != "" {
+		return errors.New(exitStatement)
+	}
+	var invitation config.Config
+	if err = json.Unmarshal(received, &invitation); err != nil {
+		return fmt.Errorf("invalid config from the inviting device: %w", err)
+	}
+	if invitation.ID == "" || invitation.PSK == "" {
+		return errors.New("invalid config from the inviting device: missing ID or PSK")
+	}
+	if _, err = config.Import(string(received)); err != nil {
+		return err
+	}
+	// Only now the roster of the new group replaces that of the previous one, if any
+	if err = group.Save(); err != nil {
+		return err
+	}
+	fmt.Println("acp is set up on this machine.")
+	return nil
+}
@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/contextualist/acp/pkg/config"
 	"github.com/contextualist/acp/pkg/pnet"
+	"github.com/contextualist/acp/pkg/roster"
 	"github.com/contextualist/acp/pkg/stream"
 	"github.com/contextualist/acp/pkg/tui"
 )
@@ -23,10 +25,30 @@ const UsageBrief = `Usage:
   acp
   # or receive to/as specified target
   acp -d path/to/target
+
+  # share with someone outside your devices, who receives with the code printed
+  acp --share path/to/files
+  acp --code 7-tiger-anchor
+
+Commands:
+  acp devices [approve|revoke <name>]
+                               list the devices sharing the config, or approve or revoke one
+  acp doctor                   diagnose network conditions for connecting to peers
+  acp invite                   show a one-time code for setting up another device
+  acp join <code>              set up this device with the code from acp invite
+  acp passphrase [--remove]    encrypt the PSK on this device with a passphrase, or stop doing so
+  acp relay [--listen :8001]   run a relay for peers that cannot connect directly
+  acp rotate-key               replace the PSK, which the other devices pick up as they connect
+  acp server [--listen :8000]  run a rendezvous server (and a relay with --relay) for self-hosting
 `
 
 var buildTag string // build-time injected
 
+const (
+	cleanupTimeout   = 5 * time.Second
+	defaultRetryWait = 5 * time.Minute
+)
+
 var (
 	destination = flag.String("d", ".", "Save files to target directory / rename received file")
 	debug       = flag.Bool("debug", false, "Enable debug logging")
@@ -34,13 +56,41 @@ var (
 	doSetupWith = flag.String("setup-with", "", "Initialize config with the specified value")
 	doUpdate    = flag.Bool("update", false, "Update itself if a new version exists")
 	showVersion = flag.Bool("version", false, "Print version and exit")
+	offline     = flag.Bool("offline", false, "Find the peer on LAN only, without the rendezvous server")
+	doRetry     = flag.Bool("retry", false, "Keep trying until the peer connects, re-exchanging each time (see --wait)")
+	wait        = flag.Duration("wait", 0, "How long to keep trying with --retry (default 5m); implies --retry")
+	share       = flag.Bool("share", false, "Send to someone outside your devices with a one-time code, instead of the PSK")
+	code        = flag.String("code", "", "Receive from `acp --share` with the code it prints")
+	yes         = flag.Bool("yes", false, "Receive without asking, even if confirm is set in the config")
 )
 
+// Subcommands are dispatched by the first argument, each parsing its own flags
+var subcommands = map[string]func(args []string) error{
+	"devices":    runDevices,
+	"doctor":     runDoctor,
+	"invite":     runInvite,
+	"join":       runJoin,
+	"passphrase": runPassphrase,
+	"relay":      runRelay,
+	"rotate-key": runRotateKey,
+	"server":     runServer,
+}
+
 var logger tui.LoggerControl
 
 var exitStatement string
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	flag.Usage = func() {
 		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "%s (%s)\n%s\nOptions:\n", os.Args[0], buildTag, UsageBrief)
 		flag.PrintDefaults()
@@ -68,22 +118,85 @@ func main() {
 	}
 
 	filenames := flag.Args()
-	conf := config.MustGetConfig()
+	var conf *config.Config
+	if *share || *code != "" {
+		if *share == (len(filenames) == 0) || *share && *code != "" || *offline {
+			fmt.Fprintln(os.Stderr, "Use --share with the files to send, and --code on the other side to receive them, with the server")
+			os.Exit(1)
+		}
+		if *share {
+			*code = pnet.NewShareCode()
+			fmt.Fprintf(os.Stderr, "On the other side, run\n\n    acp --code %s\n\n", *code)
+		}
+		conf = config.MustGetConfigOrEmpty() // the receiver might not have acp set up
+	} else {
+		conf = config.MustGetConfig()
+	}
 	conf.ApplyDefault()
 
+	sess := session{code: *code}
+	if len(filenames) > 0 {
+		sess.manifest = newManifest(filenames)
+		sess.send = func(s io.WriteCloser, logf func(string, ...any)) error { return sendFiles(filenames, s, logf) }
+	} else {
+		sess.decide = confirmer(conf)
+		sess.receive = receiveFiles
+	}
+	run(conf, sess)
+}
+
+// A session is a transfer, keyed by the PSK or a one-time code, in either direction
+type session struct {
+	// One-time code keying the session in place of the PSK, if any
+	code string
+	// How long the code stays valid, if limited
+	timeout time.Duration
+	// Group to enroll the peer keyed by the code in, or to be enrolled in if receiving
+	group *roster.Group
+	// Either of them
+	send    func(s io.WriteCloser, logf func(string, ...any)) error
+	receive func(s io.ReadCloser) error
+	// What is being sent, offered to the receiver ahead, and how the receiver decides on the offer
+	manifest *manifest
+	decide   func(m *manifest, peer *roster.Device) error
+}
+
+// run carries out the session with the progress displayed, setting exitStatement if failed
+func run(conf *config.Config, sess session) {
 	ctx, userCancel := context.WithCancel(context.Background())
 	logger = tui.NewLoggerControl(*debug)
 	loggerModel := tui.NewLoggerModel(logger)
-	go transfer(ctx, conf, filenames, loggerModel)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		transfer(ctx, conf, sess, loggerModel)
+	}()
 	tui.RunProgram(loggerModel, userCancel, *destination == "-")
+
+	// On user interrupt, the program quits before the transfer winds down; let it clean up
+	logger.Discard()
+	select {
+	case <-done:
+	case <-time.After(cleanupTimeout):
+	}
 }
 
-func transfer(ctx context.Context, conf *config.Config, filenames []string, loggerModel tea.Model) {
+func transfer(ctx context.Context, conf *config.Config, sess session, loggerModel tea.Model) {
 	pnet.SetLogger(logger)
 	stream.SetLogger(logger)
 	defer logger.End()
 
-	sinfo := pnet.SelfInfo{ChanName: conf.ID}
+	if !checkErr(setProxy(conf)) || !checkErr(pinPort(conf)) {
+		return
+	}
+	var sinfo pnet.SelfInfo
+	if sess.code != "" {
+		if !checkErr(setUpShare(conf, &sinfo, sess)) {
+			return
+		}
+	} else if !checkErr(setUpGroup(conf, &sinfo)) {
+		return
+	}
 	strategy, errs := tryEach(conf.Strategy, func(name string) (s string, err error) {
 		var d stream.Dialer
 		if d, err = stream.GetDialer(name); err != nil {
@@ -92,50 +205,94 @@ func transfer(ctx context.Context, conf *config.Config, filenames []string, logg
 		if err = d.Init(*conf); err != nil {
 			return "", fmt.Errorf("failed to init dialer %s: %w", name, err)
 		}
-		d.SetInfo(&sinfo)
 		return name, nil
 	})
+	// Set only after all are initialized, as some probe in the background meanwhile
+	for _, name := range strategy {
+		must(stream.GetDialer(name)).SetInfo(&sinfo)
+	}
 	sinfo.Strategy = strategy
+	sinfo.Heartbeat = true // all the dialers frame their streams with heartbeats
+	defer func() {
+		for _, name := range strategy {
+			if c, ok := must(stream.GetDialer(name)).(io.Closer); ok {
+				if err := c.Close(); err != nil {
+					logger.Debugf("failed to clean up dialer %s: %v", name, err)
+				}
+			}
+		}
+	}()
 	if len(strategy) == 0 {
 		checkErr(fmt.Errorf("none of the dialers from the strategy is available: %w", errors.Join(errs...)))
 		return
 	}
 
-	info, err := pnet.ExchangeConnInfo(
-		ctx,
-		conf.Server+"/v2/exchange",
-		&sinfo,
-		conf.Ports[0],
-		conf.UseIPv6,
-	)
-	if !checkErr(err) {
-		return
+	retryWait := *wait
+	if *doRetry && retryWait == 0 {
+		retryWait = defaultRetryWait
+	}
+	waitCtx := ctx
+	if sess.code != "" {
+		// A code is good for one attempt, so that it cannot be guessed over retries
+		retryWait = 0
+		if sess.timeout > 0 {
+			var cancel context.CancelFunc
+			waitCtx, cancel = context.WithTimeout(ctx, sess.timeout)
+			defer cancel()
+		}
 	}
 
 	var status interface {
 		Next(tea.Model) string
 		Logf(string, ...any)
 	}
-	if len(filenames) > 0 {
+	var err error
+	if sess.send != nil {
 		var s io.WriteCloser
-		strategyFinal := strategyConsensus(strategy, info.Strategy)
-		s, err = tryUntil(strategyFinal, func(dn string) (io.WriteCloser, error) { return must(stream.GetDialer(dn)).IntoSender(ctx, *info) })
-		if !checkErr(err) {
+		s, err = retry(waitCtx, retryWait, func(waitCtx context.Context) (io.WriteCloser, error) {
+			info, err := exchange(waitCtx, conf, &sinfo)
+			if err != nil {
+				return nil, err
+			}
+			strategyFinal := strategyConsensus(strategy, info.Strategy)
+			return tryUntil(strategyFinal, func(dn string) (io.WriteCloser, error) { return must(stream.GetDialer(dn)).IntoSender(ctx, *info) })
+		})
+		if !checkErr(shareErr(waitCtx, sess, err)) {
 			return
 		}
+		if sess.manifest != nil {
+			if err = offer(s, sess.manifest); err != nil {
+				_ = s.Close()
+				checkErr(err)
+				return
+			}
+		}
 		s, status = monitor(s)
 		logger.Debugf("sending...")
-		err = sendFiles(filenames, s, status.Logf)
+		err = sess.send(s, status.Logf)
 	} else {
 		var s io.ReadCloser
-		strategyFinal := strategyConsensus(info.Strategy, strategy)
-		s, err = tryUntil(strategyFinal, func(dn string) (io.ReadCloser, error) { return must(stream.GetDialer(dn)).IntoReceiver(ctx, *info) })
-		if !checkErr(err) {
+		s, err = retry(waitCtx, retryWait, func(waitCtx context.Context) (io.ReadCloser, error) {
+			info, err := exchange(waitCtx, conf, &sinfo)
+			if err != nil {
+				return nil, err
+			}
+			strategyFinal := strategyConsensus(info.Strategy, strategy)
+			return tryUntil(strategyFinal, func(dn string) (io.ReadCloser, error) { return must(stream.GetDialer(dn)).IntoReceiver(ctx, *info) })
+		})
+		if !checkErr(shareErr(waitCtx, sess, err)) {
 			return
 		}
+		if sess.decide != nil {
+			if err = review(s, sess.decide); err != nil {
+				_ = s.Close()
+				checkErr(err)
+				return
+			}
+		}
 		s, status = monitor(s)
 		logger.Debugf("receiving...")
-		err = receiveFiles(s)
+		err = sess.receive(s)
 	}
 
 	if !*debug {
@@ -144,6 +301,32 @@ func transfer(ctx context.Context, conf *config.Config, filenames []string, logg
 	checkErr(err)
 }
 
+// setUpGroup authenticates the transfer by the PSK and the device key
+func setUpGroup(conf *config.Config, sinfo *pnet.SelfInfo) error {
+	psk, prev, err := conf.Keys()
+	if err != nil {
+		return err
+	}
+	group, err := roster.Open(config.Dir())
+	if err != nil {
+		return err
+	}
+	stream.SetGroup(group)
+	pickUp := func(r *stream.KeyRotation) { pickUpKey(conf, r) }
+	if prev != nil {
+		// Meet the devices yet to pick up the new PSK on the previous one, and hand it over to them
+		sinfo.Authenticate(conf.ID, prev, conf.PlainInfo)
+		stream.SetRotation(&stream.KeyRotation{PSK: psk, Until: conf.PrevPSKUntil}, pickUp)
+	} else {
+		sinfo.Authenticate(conf.ID, psk, conf.PlainInfo)
+		stream.SetRotation(nil, pickUp)
+	}
+	if conf.LegacyChannel {
+		sinfo.UseLegacyChannel(conf.ID)
+	}
+	return nil
+}
+
 func monitor[T io.Closer](s T) (T, *tui.StatusControl[T]) {
 	var status *tui.StatusControl[T]
 	if !*debug {
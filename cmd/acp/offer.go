@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"github.com/contextualist/acp/pkg/config"
+	"github.com/contextualist/acp/pkg/roster"
+	"github.com/contextualist/acp/pkg/stream"
+)
+
+const maxManifestNames = 10
+
+// A manifest describes the files being sent, offered to the receiver ahead of the data
+type manifest struct {
+	Files int    `json:"files"`
+	Size  uint64 `json:"size"`
+	// The first maxManifestNames top-level names, out of NumNames
+	Names    []string `json:"names"`
+	NumNames int      `json:"numNames"`
+	// Piped from stdin, of unknown size
+	Stdin bool `json:"stdin,omitempty"`
+}
+
+// newManifest walks the files to send. Those failing are left out, as they are when sending.
+func newManifest(filenames []string) *manifest {
+	m := &manifest{NumNames: len(filenames)}
+	if len(filenames) == 1 && filenames[0] == "-" {
+		m.Stdin = true
+		return m
+	}
+	for _, fname := range filenames {
+		fname, err := filepath.Abs(fname)
+		if err != nil {
+			continue
+		}
+		if len(m.Names) < maxManifestNames {
+			m.Names = append(m.Names, filepath.Base(fname))
+		}
+		_ = filepath.Walk(fname, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				m.Files++
+				m.Size += uint64(info.Size())
+			}
+			return nil
+		})
+	}
+	return m
+}
+
+func (m *manifest) String() string {
+	if m.Stdin {
+		return "a stream from stdin"
+	}
+	names := strings.Join(m.Names, ", ")
+	if more := m.NumNames - len(m.Names); more > 0 {
+		names += fmt.Sprintf(" and %d more", more)
+	}
+	return fmt.Sprintf("%d file%s (%s): %s", m.Files, tern(m.Files == 1, "", "s"), humanize.Bytes(m.Size), names)
+}
+
+// offer describes the files to the receiver, and waits for it to accept them.
+// Streams without a way back to the sender go ahead right away.
+func offer(s any, m *manifest) error {
+	o, ok := s.(stream.Offerer)
+	if !ok {
+		return nil
+	}
+	desc, _ := json.Marshal(m)
+	logger.Infof("waiting for the receiver to accept...")
+	return o.Offer(desc)
+}
+
+// review answers the offer of the sender as decided by decide. Streams from older senders carry no
+// offer, on which decide is asked with a nil manifest and the transfer is aborted if it objects.
+func review(s any, decide func(m *manifest, peer *roster.Device) error) error {
+	o, ok := s.(stream.OfferReceiver)
+	if !ok {
+		return decide(nil, nil)
+	}
+	desc, peer, err := o.Offered()
+	if err != nil {
+		return err
+	}
+	var m manifest
+	if err = json.Unmarshal(desc, &m); err != nil {
+		_ = o.Answer(false)
+		return fmt.Errorf("error parsing the offer from the sender: %w", err)
+	}
+	if err = decide(&m, peer); err != nil {
+		_ = o.Answer(false)
+		return err
+	}
+	return o.Answer(true)
+}
+
+// confirmer decides on offers as configured: files from the devices in AcceptFrom are taken without
+// asking, and so are all of them if Confirm is unset or with --yes
+func confirmer(conf *config.Config) func(m *manifest, peer *roster.Device) error {
+	return func(m *manifest, peer *roster.Device) error {
+		if *yes || !conf.Confirm || peer != nil && slices.Contains(conf.AcceptFrom, peer.Name) {
+			return nil
+		}
+		from := "a sender outside your devices"
+		if peer != nil {
+			from = "device " + peer.Name
+		}
+		what := "files not described by the sender"
+		if m != nil {
+			what = m.String()
+		}
+		if !interactive() {
+			return fmt.Errorf("not receiving %s from %s, as there is no terminal to confirm; use --yes, or add the device to acceptFrom in the config", what, from)
+		}
+		if !logger.Confirm(fmt.Sprintf("Receive %s from %s?", what, from)) {
+			return errors.New("transfer rejected")
+		}
+		return nil
+	}
+}
+
+// interactive tells if the user can answer a prompt
+func interactive() bool {
+	if os.Getenv("CI") != "" {
+		return false
+	}
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
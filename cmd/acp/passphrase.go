@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/contextualist/acp/pkg/config"
+)
+
+func runPassphrase(args []string) error {
+	fs := flag.NewFlagSet("passphrase", flag.ExitOnError)
+	remove := fs.Bool("remove", false, "Store the PSK in the clear again")
+	lock := fs.Bool("lock", false, "Forget the passphrase remembered for unlockCache")
+	_ = fs.Parse(args)
+
+	if *lock {
+		return config.Lock()
+	}
+	conf := config.MustGetConfig()
+	if *remove {
+		if conf.Sealed == nil {
+			return errors.New("the PSK is not encrypted with a passphrase")
+		}
+		if err := conf.SetPassphrase(""); err != nil {
+			return err
+		}
+		fmt.Println("The PSK is stored in the clear.")
+		return nil
+	}
+	passphrase, err := config.ReadNewPassphrase("New passphrase: ")
+	if err != nil {
+		return err
+	}
+	if passphrase == "" {
+		return errors.New("empty passphrase; use --remove to store the PSK in the clear")
+	}
+	if err = conf.SetPassphrase(passphrase); err != nil {
+		return err
+	}
+	fmt.Printf("The PSK is encrypted with the passphrase, which is asked on each use, or taken from %s if set.\n", config.PassphraseEnv)
+	return nil
+}
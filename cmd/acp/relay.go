@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"github.com/contextualist/acp/pkg/relay"
+)
+
+func runRelay(args []string) error {
+	fs := flag.NewFlagSet("relay", flag.ExitOnError)
+	listen := fs.String("listen", ":8001", "Address to listen on")
+	newRelay := relayFlags(fs, "0")
+	_ = fs.Parse(args)
+
+	r, err := newRelay()
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/relay", r)
+	log.Printf("relay listening on %s", *listen)
+	return http.ListenAndServe(*listen, mux)
+}
+
+// relayFlags defines the options of a relay on fs, returning the constructor of the relay to call once parsed
+func relayFlags(fs *flag.FlagSet, defaultRate string) func() (*relay.Server, error) {
+	rate := fs.String("rate", defaultRate, "Bandwidth limit per channel (e.g. 10MB), 0 for unlimited")
+	maxDuration := fs.Duration("max-duration", time.Hour, "Maximum lifetime of a channel, 0 for unlimited")
+	pairTimeout := fs.Duration("pair-timeout", 30*time.Second, "How long a peer waits for the other to show up")
+	return func() (*relay.Server, error) {
+		rateLimit, err := humanize.ParseBytes(*rate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate %q: %w", *rate, err)
+		}
+		return &relay.Server{
+			RateLimit:   int64(rateLimit),
+			MaxDuration: *maxDuration,
+			PairTimeout: *pairTimeout,
+			Logf:        log.Printf,
+		}, nil
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/contextualist/acp/pkg/config"
+)
+
+const (
+	defaultGrace = 7 * 24 * time.Hour
+	// Longest grace period, including that taken from a peer
+	maxGrace = 30 * 24 * time.Hour
+)
+
+func runRotateKey(args []string) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	grace := fs.Duration("grace", defaultGrace, "How long the previous PSK stays valid, for the other devices to pick up the new one")
+	_ = fs.Parse(args)
+	if *grace > maxGrace {
+		return fmt.Errorf("the grace period is limited to %v", maxGrace)
+	}
+
+	conf := config.MustGetConfig()
+	if until := time.Unix(conf.PrevPSKUntil, 0); conf.PrevPSK != "" && time.Now().Before(until) {
+		return fmt.Errorf("the last rotation is still underway until %s; rotating again would cut off the devices yet to pick it up",
+			until.Format(time.DateTime))
+	}
+	until := time.Now().Add(*grace)
+	if _, err := config.Rotate("", until); err != nil {
+		return err
+	}
+	fmt.Printf("The PSK is replaced. Until %s, the other devices pick up the new one the next time they connect to\n"+
+		"a device that has it, and the previous one is still accepted. Devices missing it by then need to be set up again.\n\n",
+		until.Format(time.DateTime))
+	return config.Setup("")
+}
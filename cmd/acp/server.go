@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/contextualist/acp/pkg/rendezvous"
+)
+
+func runServer(args []string) error {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	listen := fs.String("listen", ":8000", "Address to listen on")
+	withRelay := fs.Bool("relay", false, "Also run a relay at /relay, limited by --rate, --max-duration and --pair-timeout")
+	newRelay := relayFlags(fs, "10MB")
+	meshSelf := fs.String("mesh-self", "", "URL where other server nodes reach this one (served at --mesh-listen), to pair peers across nodes")
+	meshListen := fs.String("mesh-listen", ":8100", "Address to listen on for other server nodes of the mesh")
+	meshPeers := fs.String("mesh-peers", "", "Comma-separated URLs of other server nodes to join the mesh through")
+	meshSecret := fs.String("mesh-secret", "", "Secret shared by all server nodes of the mesh, required with --mesh-self")
+	trustProxy := fs.Bool("trust-proxy", false, "Take the client address from X-Real-IP (or X-Forwarded-For) and X-Real-Port, set by a reverse proxy in front")
+	_ = fs.Parse(args)
+
+	mux := http.NewServeMux()
+	server := &rendezvous.Server{Logf: log.Printf, TrustProxy: *trustProxy}
+	if *meshSelf != "" {
+		if *meshSecret == "" {
+			return errors.New("--mesh-secret is required for the mesh, or anyone could join it")
+		}
+		mesh := &rendezvous.Mesh{
+			Self:   *meshSelf,
+			Secret: *meshSecret,
+			Logf:   log.Printf,
+		}
+		if *meshPeers != "" {
+			mesh.Seeds = strings.Split(*meshPeers, ",")
+		}
+		// Apart from the clients, so that the mesh can be firewalled off to the other nodes
+		meshMux := http.NewServeMux()
+		meshMux.Handle(rendezvous.MeshPath, mesh)
+		go func() {
+			log.Printf("mesh listening on %s", *meshListen)
+			log.Fatal(http.ListenAndServe(*meshListen, meshMux))
+		}()
+		go mesh.Run(context.Background())
+		server.Exchanger = mesh
+	}
+	mux.Handle("/", server)
+	if *withRelay {
+		r, err := newRelay()
+		if err != nil {
+			return err
+		}
+		mux.Handle("/relay", r)
+	}
+	log.Printf("rendezvous server listening on %s", *listen)
+	return http.ListenAndServe(*listen, mux)
+}
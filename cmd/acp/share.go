@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/contextualist/acp/pkg/config"
+	"github.com/contextualist/acp/pkg/pnet"
+	"github.com/contextualist/acp/pkg/stream"
+)
+
+// setUpShare keys the transfer by a one-time code instead of the PSK, for someone outside the group.
+// Neither the PSK nor the device roster is involved, unless enrolling a new device.
+func setUpShare(conf *config.Config, sinfo *pnet.SelfInfo, sess session) error {
+	if err := sinfo.Share(sess.code); err != nil {
+		return err
+	}
+	if sess.group != nil {
+		stream.SetEnrollment(sess.group, sess.send != nil) // the inviting device sends the config
+	}
+	conf.PSK, conf.PrevPSK = "", ""
+	conf.LAN = false
+	// Taildrop is not keyed by the session, and the peer is hardly on the same tailnet anyway
+	conf.Strategy = slices.DeleteFunc(slices.Clone(conf.Strategy), func(s string) bool { return s == "tailscale" })
+	if len(conf.Strategy) == 0 {
+		conf.Strategy = []string{"tcp_punch"}
+	}
+	return nil
+}
+
+// shareErr explains a failure to connect with a code: a mistyped code fails the handshake,
+// and an expired one times out the wait
+func shareErr(waitCtx context.Context, sess session, err error) error {
+	switch {
+	case sess.code == "" || err == nil:
+		return err
+	case errors.Is(waitCtx.Err(), context.DeadlineExceeded):
+		return errors.New("the code has expired")
+	case errors.Is(err, stream.ErrHandshake):
+		return fmt.Errorf("the code does not match on both sides; check it, or start over with a new one (%w)", err)
+	}
+	return err
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"time"
+)
+
+const (
+	retryBackoffMin = time.Second
+	retryBackoffMax = 30 * time.Second
 )
 
 // Merge strategy lists from two parties into a common one,
@@ -52,6 +59,66 @@ func tryUntil[U, V any](a []U, fn func(U) (V, error)) (r V, err error) {
 	return
 }
 
+// Run funcs concurrently, returning the first successful result and cancelling the rest
+func race[V any](ctx context.Context, fns ...func(context.Context) (V, error)) (r V, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		v   V
+		err error
+	}
+	chResult := make(chan result, len(fns))
+	for _, fn := range fns {
+		go func() {
+			v, err := fn(ctx)
+			chResult <- result{v, err}
+		}()
+	}
+	var errs []error
+	for range fns {
+		res := <-chResult
+		if res.err == nil {
+			return res.v, nil
+		}
+		logger.Debugf("attempt failed: %v", res.err)
+		errs = append(errs, res.err)
+	}
+	err = fmt.Errorf("all attempts failed: %w", errors.Join(errs...))
+	return
+}
+
+// Run fn until it succeeds or the wait is over, backing off exponentially in between.
+// fn gets a context bounded by the wait, for the parts to be abandoned along with it.
+// A zero wait means a single attempt.
+func retry[V any](ctx context.Context, wait time.Duration, fn func(context.Context) (V, error)) (r V, err error) {
+	if wait <= 0 {
+		return fn(ctx)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	backoff := retryBackoffMin
+	for attempt := 1; ; attempt++ {
+		if r, err = fn(waitCtx); err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if waitCtx.Err() != nil {
+			err = fmt.Errorf("peer not connected within %v: %w", wait, err)
+			return
+		}
+		logger.Infof("attempt %d failed: %v; retrying in %v", attempt, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-waitCtx.Done():
+			err = fmt.Errorf("peer not connected within %v: %w", wait, err)
+			return
+		}
+		backoff = min(backoff*2, retryBackoffMax)
+	}
+}
+
 func must[T any](t T, err error) T {
 	if err != nil {
 		panic(err)
@@ -7,6 +7,31 @@ interface ClientInfo {
   nPlan?: number,
   tsAddr?: string,
   tsCap?: number,
+  udpAddrs?: string[],
+  relayNonce?: string,
+  candidates?: Candidate[],
+  nominate?: boolean,
+  nat?: NATInfo,
+  proof?: ChannelProof,
+  sealed?: string, // base64, the info encrypted for the peer
+  canUnseal?: boolean,
+  heartbeat?: boolean,
+}
+
+interface ChannelProof {
+  ts: number,
+  sig: string, // base64
+}
+
+interface Candidate {
+  addr: string,
+  kind: string,
+  prio: number,
+}
+
+interface NATInfo {
+  pattern: string,
+  delta?: number,
 }
 
 interface AddrPair {
@@ -20,6 +45,15 @@ interface ReplyInfo {
   peerNPlan?: number,
   tsAddr?: string,
   tsCap?: number,
+  udpAddrs?: string[],
+  relayNonce?: string,
+  candidates?: Candidate[],
+  nominate?: boolean,
+  nat?: NATInfo,
+  proof?: ChannelProof,
+  sealed?: string, // base64, the info encrypted for the peer
+  canUnseal?: boolean,
+  heartbeat?: boolean,
 }
 
 
@@ -31,9 +65,10 @@ async function handleExchangeV2(req: Request, connInfo: ConnInfo): Promise<Respo
 
   const pubAddr = joinHostPort(connInfo.remoteAddr as Deno.NetAddr)
   const conn = new PacketReader(req.body!)
-  const { priAddr, chanName, nPlan = 1, ...otherInfo }: ClientInfo = JSON.parse(
-    new TextDecoder().decode(await receivePacket(conn))
-  )
+  const info: ClientInfo = JSON.parse(new TextDecoder().decode(await receivePacket(conn)))
+  if (!await verifyChannel(info))
+    return new Response("Invalid channel proof", { status: 403 })
+  const { priAddr, chanName, nPlan = 1, ...otherInfo } = info
   const reply: ReplyInfo = {
     peerAddrs: [{ pubAddr, priAddr }],
     peerNPlan: nPlan,
@@ -52,6 +87,39 @@ async function handleExchangeV2(req: Request, connInfo: ConnInfo): Promise<Respo
 }
 
 
+// A channel named after an Ed25519 public key ("k." + base64url) is authenticated:
+// the info must carry a recent signature by the matching private key, derived from the PSK.
+// Keep the signed message in sync with proofMessage in pkg/pnet/auth.go.
+const CHANNEL_PREFIX = "k."
+const MAX_PROOF_SKEW_S = 120
+
+async function verifyChannel(info: ClientInfo): Promise<boolean> {
+  if (!info.chanName.startsWith(CHANNEL_PREFIX))
+    return true // legacy channel
+  const { proof } = info
+  if (proof === undefined || Math.abs(Date.now() / 1000 - proof.ts) > MAX_PROOF_SKEW_S)
+    return false
+  const msg = [
+    "acp channel proof", info.chanName, String(proof.ts), info.priAddr,
+    (info.candidates ?? []).map((c) => c.addr).join(","), (info.udpAddrs ?? []).join(","),
+    info.tsAddr ?? "", info.relayNonce ?? "", info.sealed ?? "",
+  ].join("|")
+  try {
+    const pub = decodeBase64(info.chanName.slice(CHANNEL_PREFIX.length).replace(/-/g, "+").replace(/_/g, "/"))
+    const key = await crypto.subtle.importKey("raw", pub, { name: "Ed25519" }, false, ["verify"])
+    return await crypto.subtle.verify("Ed25519", key, decodeBase64(proof.sig), new TextEncoder().encode(msg))
+  } catch {
+    return false
+  }
+}
+
+
+function decodeBase64(s: string): Uint8Array<ArrayBuffer> {
+  const bin = atob(s + "=".repeat((4 - s.length % 4) % 4))
+  return Uint8Array.from(bin, (c) => c.charCodeAt(0))
+}
+
+
 // (priAddr0|chanName) -> pubAddr1|priAddr1
 async function handleExchangeV1(req: Request, connInfo: ConnInfo): Promise<Response> {
   if (req.method != "POST")
@@ -64,6 +132,8 @@ async function handleExchangeV1(req: Request, connInfo: ConnInfo): Promise<Respo
   const [priAddr, chanName] = new TextDecoder().decode(
     await receivePacket(conn)
   ).split('|')
+  if (chanName.startsWith(CHANNEL_PREFIX)) // no room for a proof
+    return new Response("Invalid channel proof", { status: 403 })
   const x0 = `${pubAddr}|${priAddr}`
   //console.log(`accepted from ${x0}`)
 
@@ -218,7 +288,7 @@ class PacketReader {
 
 async function receivePacket(conn: PacketReader): Promise<Uint8Array> {
   const header = await conn.readN(2)
-  const lenCap = 1e3
+  const lenCap = 4e3 // raised from 1e3 for dual-stack candidates; older deployments reject them
   const plen = (header[0] << 8) | header[1] // uint16, BE
   if (plen == 0 || plen > lenCap) {
     console.error(`received suspicious packet header declearing len=${plen}`)
@@ -250,6 +320,10 @@ async function handler(req: Request, connInfo: ConnInfo): Promise<Response> {
       )
     case "/v2/exchange":
       return await handleExchangeV2(req, connInfo)
+    case "/v2/whoami":
+      return new Response(joinHostPort(connInfo.remoteAddr as Deno.NetAddr), {
+        headers: { "Content-Type": "text/plain; charset=utf-8", "Cache-Control": "no-store" },
+      })
     case "/exchange":
       return await handleExchangeV1(req, connInfo)
     default:
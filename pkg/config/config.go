@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	tsapi "github.com/contextualist/acp/pkg/tailscale"
 )
@@ -16,6 +17,8 @@ import (
 const (
 	idLen  = 6  // 6 bytes, 8 base64 chars
 	pskLen = 32 // for ChaCha20-Poly1305
+
+	DefaultServer = "https://acp.hya.moe"
 )
 
 // Config defines the user-specific information for the transfer.
@@ -27,11 +30,46 @@ type Config struct {
 	Ports    []int    `json:"ports,omitempty"`
 	UPnP     bool     `json:"upnp,omitempty"`
 	Strategy []string `json:"strategy,omitempty"`
+	// Seconds of silence from the peer before aborting a transfer
+	IdleTimeout int      `json:"idleTimeout,omitempty"`
+	STUNServers []string `json:"stunServers,omitempty"`
+	// Endpoint of the relay service, required by the relay dialer (e.g. the one hosted along with `acp server`)
+	Relay string `json:"relay,omitempty"`
+	// Whether to look for the peer on LAN in parallel with the rendezvous server
+	LAN bool `json:"lan,omitempty"`
+	// Proxy for reaching the server and the relay, e.g. socks5://host:1080 or http://host:3128;
+	// taken from the environment variables if unset, or disabled with "direct"
+	Proxy string `json:"proxy,omitempty"`
+	// Interfaces (name patterns) or address prefixes not to advertise to the peer
+	ExcludeInterfaces []string `json:"excludeInterfaces,omitempty"`
+	// Seconds to spend on hole punching in total, and on each pair of local port and peer address
+	RendezvousTimeout float64 `json:"rendezvousTimeout,omitempty"`
+	PlanTimeout       float64 `json:"planTimeout,omitempty"`
+	// Send the connection info in the clear instead of sealing it from the server, for legacy peers
+	PlainInfo bool `json:"plainInfo,omitempty"`
+	// Meet on the unauthenticated channel named by the ID, as versions before the channel authentication do
+	LegacyChannel bool `json:"legacyChannel,omitempty"`
+	// The PSK replaced by the last rotation, still accepted until PrevPSKUntil (Unix time)
+	PrevPSK      string `json:"prevPSK,omitempty"`
+	PrevPSKUntil int64  `json:"prevPSKUntil,omitempty"`
+	// Ask before receiving, showing what is being sent and from which device
+	Confirm bool `json:"confirm,omitempty"`
+	// Devices (by their names in the roster) to receive from without asking
+	AcceptFrom []string `json:"acceptFrom,omitempty"`
+	// The PSKs above, encrypted at rest with a passphrase instead of stored in the clear
+	Sealed *Sealed `json:"sealed,omitempty"`
+	// Seconds to remember the passphrase after it is entered
+	UnlockCache int `json:"unlockCache,omitempty"`
+	// Authenticate the peer over Tailscale without encrypting the stream, as WireGuard does; takes effect if both ends set it
+	TailscaleAuthOnly bool `json:"tailscaleAuthOnly,omitempty"`
+
+	// The key for sealing the secrets, once unlocked
+	key []byte
 }
 
 func (conf *Config) ApplyDefault() {
 	if conf.Server == "" {
-		conf.Server = "https://acp.hya.moe"
+		conf.Server = DefaultServer
 	}
 	if len(conf.Ports) == 0 {
 		conf.Ports = []int{0}
@@ -39,31 +77,57 @@ func (conf *Config) ApplyDefault() {
 	if len(conf.Strategy) == 0 {
 		conf.Strategy = []string{"tcp_punch"}
 	}
+	if conf.IdleTimeout == 0 {
+		conf.IdleTimeout = 60
+	}
+	if conf.RendezvousTimeout == 0 {
+		conf.RendezvousTimeout = 4
+	}
+	if conf.PlanTimeout == 0 {
+		conf.PlanTimeout = 1.6
+	}
+	if len(conf.STUNServers) == 0 {
+		conf.STUNServers = []string{"stun.l.google.com:19302", "stun.cloudflare.com:3478"}
+	}
 }
 
 // Export returns a Config with only the fields that are common to all devices of a user.
 func (conf *Config) Export() *Config {
 	return &Config{
-		ID:      conf.ID,
-		PSK:     conf.PSK,
-		Server:  conf.Server,
-		UseIPv6: conf.UseIPv6,
+		ID:           conf.ID,
+		PSK:          conf.PSK,
+		Server:       conf.Server,
+		Relay:        conf.Relay,
+		PrevPSK:      conf.PrevPSK,
+		PrevPSKUntil: conf.PrevPSKUntil,
 	}
 }
 
+// Keys decodes the PSK, along with the previous one during the grace period of a rotation
+func (conf *Config) Keys() (psk, prev []byte, err error) {
+	if psk, err = base64.StdEncoding.DecodeString(conf.PSK); err != nil {
+		return nil, nil, fmt.Errorf("error decoding PSK: %w", err)
+	}
+	if conf.PrevPSK == "" || time.Now().Unix() >= conf.PrevPSKUntil {
+		return psk, nil, nil
+	}
+	if prev, err = base64.StdEncoding.DecodeString(conf.PrevPSK); err != nil {
+		return nil, nil, fmt.Errorf("error decoding previous PSK: %w", err)
+	}
+	return psk, prev, nil
+}
+
 var configFilename = filepath.Join(userConfigDir(), "acp", "config.json")
 
+// Dir is where the config and other per-device state are stored
+func Dir() string {
+	return filepath.Dir(configFilename)
+}
+
 func Setup(confStr string) (err error) {
 	var conf *Config
 	if confStr != "" {
-		conf = &Config{}
-		if err = json.Unmarshal([]byte(confStr), conf); err != nil {
-			return err
-		}
-		if len(conf.Strategy) == 0 {
-			conf.Strategy = inferStrategy()
-		}
-		if err = setConfig(conf); err != nil {
+		if conf, err = Import(confStr); err != nil {
 			return err
 		}
 	} else {
@@ -74,7 +138,11 @@ func Setup(confStr string) (err error) {
 				PSK:      base64.StdEncoding.EncodeToString(randBytes(pskLen)),
 				Strategy: inferStrategy(),
 			}
-			if err = setConfig(conf); err != nil {
+			passphrase, err := offerPassphrase()
+			if err != nil {
+				return err
+			}
+			if err = conf.SetPassphrase(passphrase); err != nil {
 				return err
 			}
 		} else if err != nil {
@@ -84,7 +152,9 @@ func Setup(confStr string) (err error) {
 		confStr = string(confBytes)
 	}
 	conf.ApplyDefault()
-	fmt.Printf(`acp is set up on this machine. To set up another machine, run the following command there
+	fmt.Printf(`acp is set up on this machine. To set up another machine, run `+"`acp invite`"+` here, and follow the instructions.
+
+Alternatively, run the following command there
 (DO NOT share the command publicly as it contains encryption keys)
 	
     curl -fsS %s/get | sh -s -- --setup-with '%s'
@@ -98,6 +168,49 @@ If you already have the executable, run
 	return nil
 }
 
+// Import stores the config exported from another device. If the stored config is encrypted
+// with a passphrase, it is unlocked to seal the new PSK with the same passphrase.
+func Import(confStr string) (*Config, error) {
+	conf := &Config{}
+	if err := json.Unmarshal([]byte(confStr), conf); err != nil {
+		return nil, err
+	}
+	if len(conf.Strategy) == 0 {
+		conf.Strategy = inferStrategy()
+	}
+	conf.Sealed, conf.key = nil, nil
+	if isSealed() {
+		prev, err := getConfig()
+		if err != nil {
+			return nil, fmt.Errorf("the config on this device is encrypted with a passphrase, which is needed to encrypt the new PSK "+
+				"(or delete %s to set up in the clear): %w", configFilename, err)
+		}
+		conf.Sealed, conf.key, conf.UnlockCache = prev.Sealed, prev.key, prev.UnlockCache
+	}
+	if err := setConfig(conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// Rotate replaces the PSK in the stored config with psk, or a new one if empty,
+// keeping the current one valid until the given time
+func Rotate(psk string, until time.Time) (*Config, error) {
+	conf, err := getConfig()
+	if err != nil {
+		return nil, err
+	}
+	if psk == "" {
+		psk = base64.StdEncoding.EncodeToString(randBytes(pskLen))
+	}
+	conf.PrevPSK, conf.PrevPSKUntil = conf.PSK, until.Unix()
+	conf.PSK = psk
+	if err = setConfig(conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
 func MustGetConfig() *Config {
 	conf, err := getConfig()
 	if err != nil {
@@ -111,6 +224,19 @@ func MustGetConfig() *Config {
 	return conf
 }
 
+// MustGetConfigOrEmpty is MustGetConfig, except for an empty config if acp is not set up yet
+func MustGetConfigOrEmpty() *Config {
+	conf, err := getConfig()
+	if errors.Is(err, os.ErrNotExist) {
+		return &Config{}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return conf
+}
+
 func getConfig() (*Config, error) {
 	configFile, err := os.Open(configFilename)
 	if err != nil {
@@ -121,19 +247,46 @@ func getConfig() (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error parsing config: %w", err)
 	}
+	if conf.Sealed != nil {
+		if err = conf.unlock(); err != nil {
+			return nil, err
+		}
+	}
 	return &conf, nil
 }
 
+// isSealed tells whether the stored config is encrypted with a passphrase, without unlocking it
+func isSealed() bool {
+	b, err := os.ReadFile(configFilename)
+	if err != nil {
+		return false
+	}
+	var conf Config
+	return json.Unmarshal(b, &conf) == nil && conf.Sealed != nil
+}
+
 func setConfig(conf *Config) error {
 	err := os.MkdirAll(filepath.Dir(configFilename), 0o700)
 	if err != nil {
 		return fmt.Errorf("error creating config directory for %s: %v", configFilename, err)
 	}
-	configFile, err := os.Create(configFilename)
+	// Written aside and renamed over, so that it is never left half written,
+	// and readable only by the user as CreateTemp makes it
+	configFile, err := os.CreateTemp(filepath.Dir(configFilename), filepath.Base(configFilename)+".*")
 	if err != nil {
 		return fmt.Errorf("error writing config to %s: %v", configFilename, err)
 	}
+	defer os.Remove(configFile.Name())
+	if conf.key != nil {
+		conf = conf.sealed()
+	}
 	err = json.NewEncoder(configFile).Encode(conf)
+	if cerr := configFile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(configFile.Name(), configFilename)
+	}
 	if err != nil {
 		return fmt.Errorf("error writing config to %s: %v", configFilename, err)
 	}
@@ -1,12 +1,15 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"testing"
+	"time"
 )
 
 func TestSetup(t *testing.T) {
@@ -54,7 +57,122 @@ func TestSetupWith(t *testing.T) {
 
 func TestMain(m *testing.M) {
 	configFilename = filepath.Join(os.TempDir(), "acp-test-config.json")
+	unlockDir, _ := os.MkdirTemp("", "acp-test-")
+	unlockCacheFilename = func() (string, error) { return filepath.Join(unlockDir, "acp.unlock"), nil }
 	rc := m.Run()
 	_ = os.Remove(configFilename)
+	_ = os.RemoveAll(unlockDir)
 	os.Exit(rc)
 }
+
+func TestRotate(t *testing.T) {
+	if err := Setup(`{"id":"AAAAAAAA","psk":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}`); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := Rotate("", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Rotation failed: %v", err)
+	}
+	psk, prev, err := conf.Keys()
+	if err != nil || len(psk) != pskLen || len(prev) != pskLen || bytes.Equal(psk, prev) {
+		t.Fatalf("Unexpected keys after rotation: %v %v %v", psk, prev, err)
+	}
+	if stored, _ := getConfig(); !reflect.DeepEqual(stored, conf) || conf.Export().PrevPSK != conf.PrevPSK {
+		t.Fatalf("Rotation not stored or exported: %+v", stored)
+	}
+
+	conf.PrevPSKUntil = time.Now().Add(-time.Second).Unix()
+	if _, prev, _ = conf.Keys(); prev != nil {
+		t.Fatalf("Previous PSK still valid after the grace period")
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	if err := Setup(`{"id":"AAAAAAAA","psk":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}`); err != nil {
+		t.Fatal(err)
+	}
+	conf, _ := getConfig()
+	if err := conf.SetPassphrase("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unlocked = nil })
+	relock := func() {
+		unlocked = nil
+		if b, _ := os.ReadFile(configFilename); bytes.Contains(b, []byte(conf.PSK)) {
+			t.Fatalf("PSK stored in the clear: %s", b)
+		}
+	}
+	relock()
+
+	t.Setenv(PassphraseEnv, "wrong")
+	if _, err := getConfig(); !errors.Is(err, errWrongPassphrase) {
+		t.Fatalf("wrong passphrase accepted: %v", err)
+	}
+	t.Setenv(PassphraseEnv, "correct horse")
+	if c, err := getConfig(); err != nil || c.PSK != conf.PSK {
+		t.Fatalf("failed to unlock: %v", err)
+	}
+
+	// Sealed again when stored, with the passphrase entered once
+	rotated, err := Rotate("", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	relock()
+	_ = os.Unsetenv(PassphraseEnv)
+	if err = writeUnlockCache(rotated.Sealed.Salt, rotated.key, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := getConfig(); err != nil || c.PSK != rotated.PSK || c.PrevPSK != conf.PSK {
+		t.Fatalf("failed to unlock with the cache: %+v, %v", c, err)
+	}
+
+	salt := rotated.Sealed.Salt
+	if err = rotated.SetPassphrase(""); err != nil {
+		t.Fatal(err)
+	}
+	unlocked = nil
+	if c, err := getConfig(); err != nil || c.PSK != rotated.PSK || c.Sealed != nil {
+		t.Fatalf("PSK not stored in the clear again: %+v, %v", c, err)
+	}
+	if readUnlockCache(salt) != nil {
+		t.Errorf("passphrase still remembered")
+	}
+}
+
+func TestImportSealed(t *testing.T) {
+	if err := Setup(`{"id":"AAAAAAAA","psk":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}`); err != nil {
+		t.Fatal(err)
+	}
+	conf, _ := getConfig()
+	if err := conf.SetPassphrase("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		unlocked = nil
+		_ = os.Remove(configFilename)
+	})
+
+	const psk = "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB="
+	t.Setenv(PassphraseEnv, "wrong")
+	if _, err := Import(`{"id":"BBBBBBBB","psk":"` + psk + `"}`); !errors.Is(err, errWrongPassphrase) {
+		t.Fatalf("imported without the passphrase: %v", err)
+	}
+	t.Setenv(PassphraseEnv, "correct horse")
+	if _, err := Import(`{"id":"BBBBBBBB","psk":"` + psk + `"}`); err != nil {
+		t.Fatal(err)
+	}
+	unlocked = nil
+	b, _ := os.ReadFile(configFilename)
+	if bytes.Contains(b, []byte(psk)) {
+		t.Fatalf("imported PSK stored in the clear: %s", b)
+	}
+	if c, err := getConfig(); err != nil || c.ID != "BBBBBBBB" || c.PSK != psk {
+		t.Fatalf("failed to unlock the imported config: %+v, %v", c, err)
+	}
+	if fi, err := os.Stat(configFilename); err != nil {
+		t.Error(err)
+	} else if runtime.GOOS != "windows" && fi.Mode().Perm()&0o077 != 0 {
+		t.Errorf("config readable by others: %v", fi.Mode())
+	}
+}
@@ -0,0 +1,254 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/x/term"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// Parameters of scrypt recommended for interactive logins, taking about 100ms
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+	saltLen = 16
+
+	// Environment variable with the passphrase, for unattended use
+	PassphraseEnv = "ACP_PASSPHRASE"
+)
+
+var errWrongPassphrase = errors.New("wrong passphrase")
+
+// Sealed is the secrets of a Config encrypted with a key derived from a passphrase by scrypt
+type Sealed struct {
+	Salt  []byte `json:"salt"`
+	N     int    `json:"n"`
+	R     int    `json:"r"`
+	P     int    `json:"p"`
+	Nonce []byte `json:"nonce"`
+	Box   []byte `json:"box"`
+}
+
+// secrets are the fields of Config that are sealed at rest
+type secrets struct {
+	PSK     string `json:"psk"`
+	PrevPSK string `json:"prevPSK,omitempty"`
+}
+
+func (s *Sealed) deriveKey(passphrase string) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), s.Salt, s.N, s.R, s.P, chacha20poly1305.KeySize)
+}
+
+// SetPassphrase has the secrets in the stored config encrypted with the passphrase, or kept in the clear if empty
+func (conf *Config) SetPassphrase(passphrase string) error {
+	conf.Sealed, conf.key = nil, nil
+	if passphrase != "" {
+		s := &Sealed{Salt: randBytes(saltLen), N: scryptN, R: scryptR, P: scryptP}
+		key, err := s.deriveKey(passphrase)
+		if err != nil {
+			return err
+		}
+		conf.Sealed, conf.key = s, key
+	}
+	unlocked = nil
+	_ = Lock()
+	return setConfig(conf)
+}
+
+// sealed returns the config to be stored, with the secrets encrypted
+func (conf *Config) sealed() *Config {
+	c := *conf
+	b, _ := json.Marshal(&secrets{PSK: conf.PSK, PrevPSK: conf.PrevPSK})
+	aead, _ := chacha20poly1305.NewX(conf.key)
+	s := *conf.Sealed
+	s.Nonce = randBytes(aead.NonceSize())
+	s.Box = aead.Seal(nil, s.Nonce, b, nil)
+	c.Sealed, c.PSK, c.PrevPSK = &s, "", ""
+	return &c
+}
+
+func (conf *Config) unseal(key []byte) error {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	if len(conf.Sealed.Nonce) != aead.NonceSize() {
+		return errors.New("invalid sealed secrets in config")
+	}
+	b, err := aead.Open(nil, conf.Sealed.Nonce, conf.Sealed.Box, nil)
+	if err != nil {
+		return errWrongPassphrase
+	}
+	var s secrets
+	if err = json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("error parsing sealed secrets: %w", err)
+	}
+	conf.PSK, conf.PrevPSK, conf.key = s.PSK, s.PrevPSK, key
+	return nil
+}
+
+func (conf *Config) unsealWith(passphrase string) error {
+	key, err := conf.Sealed.deriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+	return conf.unseal(key)
+}
+
+// The key unlocked earlier in this process, so that the passphrase is asked at most once
+var unlocked []byte
+
+// unlock decrypts the secrets with the key unlocked earlier or cached,
+// or with the passphrase from the environment or the terminal, in that order
+func (conf *Config) unlock() error {
+	if unlocked != nil && conf.unseal(unlocked) == nil {
+		return nil
+	}
+	if key := readUnlockCache(conf.Sealed.Salt); key != nil && conf.unseal(key) == nil {
+		unlocked = key
+		return nil
+	}
+	if passphrase, ok := os.LookupEnv(PassphraseEnv); ok {
+		if err := conf.unsealWith(passphrase); err != nil {
+			return fmt.Errorf("error unlocking config with %s: %w", PassphraseEnv, err)
+		}
+		unlocked = conf.key
+		return nil
+	}
+	if !term.IsTerminal(os.Stdin.Fd()) {
+		return fmt.Errorf("the config is locked with a passphrase; enter it in a terminal, or set %s", PassphraseEnv)
+	}
+	for range 3 {
+		passphrase, err := ReadPassphrase("Passphrase for acp: ")
+		if err != nil {
+			return err
+		}
+		if err = conf.unsealWith(passphrase); err == nil {
+			unlocked = conf.key
+			if conf.UnlockCache > 0 {
+				if err = writeUnlockCache(conf.Sealed.Salt, conf.key, time.Duration(conf.UnlockCache)*time.Second); err != nil {
+					fmt.Fprintf(os.Stderr, "The passphrase is not remembered: %v\n", err)
+				}
+			}
+			return nil
+		} else if !errors.Is(err, errWrongPassphrase) {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Wrong passphrase, try again.")
+	}
+	return errWrongPassphrase
+}
+
+// offerPassphrase asks for a passphrase for a new config, taken from the environment if set
+func offerPassphrase() (string, error) {
+	if passphrase, ok := os.LookupEnv(PassphraseEnv); ok {
+		return passphrase, nil
+	}
+	if !term.IsTerminal(os.Stdin.Fd()) {
+		return "", nil
+	}
+	fmt.Fprintln(os.Stderr, "The PSK can be encrypted on this machine with a passphrase, to be entered on each use.")
+	return ReadNewPassphrase("Passphrase (leave empty to store the PSK in the clear): ")
+}
+
+// ReadPassphrase prompts for a passphrase on the terminal, without echoing it
+func ReadPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	b, err := term.ReadPassword(os.Stdin.Fd())
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("error reading passphrase: %w", err)
+	}
+	return string(b), nil
+}
+
+// ReadNewPassphrase prompts for a passphrase twice, which might be empty
+func ReadNewPassphrase(prompt string) (string, error) {
+	passphrase, err := ReadPassphrase(prompt)
+	if err != nil || passphrase == "" {
+		return "", err
+	}
+	again, err := ReadPassphrase("Enter it again: ")
+	if err != nil {
+		return "", err
+	}
+	if again != passphrase {
+		return "", errors.New("the passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// The unlock cache keeps the key derived from the passphrase for a while after it is entered,
+// in a directory private to the user (see privateDir). Without one, nothing is cached.
+type unlockCache struct {
+	Salt  []byte `json:"salt"`
+	Key   []byte `json:"key"`
+	Until int64  `json:"until"`
+}
+
+var unlockCacheFilename = sync.OnceValues(func() (string, error) {
+	dir, err := privateDir()
+	if err != nil {
+		return "", fmt.Errorf("no private directory for the unlock cache: %w", err)
+	}
+	return filepath.Join(dir, "acp.unlock"), nil
+})
+
+func readUnlockCache(salt []byte) []byte {
+	filename, err := unlockCacheFilename()
+	if err != nil {
+		return nil
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	var c unlockCache
+	if json.Unmarshal(b, &c) != nil || !bytes.Equal(c.Salt, salt) || time.Now().Unix() >= c.Until {
+		return nil
+	}
+	return c.Key
+}
+
+func writeUnlockCache(salt, key []byte, d time.Duration) error {
+	filename, err := unlockCacheFilename()
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	b, _ := json.Marshal(&unlockCache{Salt: salt, Key: key, Until: time.Now().Add(d).Unix()})
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// Lock forgets the passphrase remembered by the unlock cache
+func Lock() error {
+	filename, err := unlockCacheFilename()
+	if err != nil {
+		return nil // nothing could have been cached
+	}
+	err = os.Remove(filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
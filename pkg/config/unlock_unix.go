@@ -0,0 +1,38 @@
+//go:build !windows && !wasm
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// privateDir returns a directory only this user can access: the runtime directory,
+// or one of its own in the temporary directory
+func privateDir() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir, checkPrivate(dir)
+	}
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("acp-%d", os.Getuid()))
+	if err := os.Mkdir(dir, 0o700); err != nil && !errors.Is(err, os.ErrExist) {
+		return "", err
+	}
+	return dir, checkPrivate(dir)
+}
+
+// checkPrivate makes sure that dir is a directory of this user closed to others,
+// as one in a shared location might have been put there by someone else
+func checkPrivate(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || !ok || int(st.Uid) != os.Getuid() || fi.Mode().Perm()&0o077 != 0 {
+		return fmt.Errorf("%s is not a directory private to this user", dir)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+//go:build !windows && !wasm
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrivateDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	if got, err := privateDir(); err != nil || got != dir {
+		t.Errorf("private runtime dir rejected: %s, %v", got, err)
+	}
+
+	// One open to others, or a link to one, is not taken
+	if err := os.Chmod(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := privateDir(); err == nil {
+		t.Errorf("shared dir taken")
+	}
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("XDG_RUNTIME_DIR", link)
+	if _, err := privateDir(); err == nil {
+		t.Errorf("symlink taken")
+	}
+}
@@ -0,0 +1,16 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// privateDir returns a directory only this user can access, under the local app data of the profile
+func privateDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir = filepath.Join(dir, "acp")
+	return dir, os.MkdirAll(dir, 0o700)
+}
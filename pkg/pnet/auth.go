@@ -0,0 +1,124 @@
+package pnet
+
+import (
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Channel authentication keeps strangers who learn the ID off our rendezvous channel.
+//
+// The channel is named after an Ed25519 public key derived from the PSK, and every exchange carries
+// a proof: a signature by the matching private key over a timestamp and the addresses offered.
+// The server checks the proof against the channel name without learning the PSK, and the peer
+// checks it before trusting the addresses.
+//
+// Versions before this meet on the channel named by the ID alone, so the two never find each other.
+// UseLegacyChannel goes back to that channel, unauthenticated, for a device to meet such a peer.
+
+const (
+	// Marks a channel name as a public key, distinct from any legacy ID
+	channelPrefix = "k."
+	maxProofSkew  = 2 * time.Minute
+)
+
+// ChannelProof proves the possession of the PSK behind the channel
+type ChannelProof struct {
+	TS  int64  `json:"ts"`
+	Sig []byte `json:"sig"`
+}
+
+// Authenticate names the channel after the ID and PSK, and has the info signed when exchanged.
+// The info is also sealed from the server, unless plain is set for legacy peers.
+func (info *SelfInfo) Authenticate(id string, psk []byte, plain bool) {
+	seed, _ := hkdf.Key(sha256.New, psk, []byte(id), "acp channel key", ed25519.SeedSize)
+	info.key = ed25519.NewKeyFromSeed(seed)
+	info.ChanName = channelPrefix + base64.RawURLEncoding.EncodeToString(info.key.Public().(ed25519.PublicKey))
+	info.sealKey, _ = hkdf.Key(sha256.New, psk, []byte(id), "acp info seal", chacha20poly1305.KeySize)
+	info.plain = plain
+	info.CanUnseal = plain
+}
+
+// UseLegacyChannel names the channel after the ID alone, as versions before the channel authentication
+// do. The info then goes unsigned and in the clear, as those versions can neither check nor open it.
+func (info *SelfInfo) UseLegacyChannel(id string) {
+	info.ChanName = id
+	info.key, info.sealKey = nil, nil
+	info.plain, info.CanUnseal = true, false
+}
+
+// IsAuthenticatedChannel tells whether the channel is named after a public key
+func IsAuthenticatedChannel(chanName string) bool {
+	return strings.HasPrefix(chanName, channelPrefix)
+}
+
+func (info *SelfInfo) sign() {
+	if info.key == nil {
+		return
+	}
+	ts := time.Now().Unix()
+	msg := proofMessage(info.ChanName, ts, info.PriAddr, info.Candidates, info.UDPAddrs, info.TSAddr, info.RelayNonce, info.Sealed)
+	info.Proof = &ChannelProof{TS: ts, Sig: ed25519.Sign(info.key, msg)}
+}
+
+// VerifyChannel checks the proof of an info sent to an authenticated channel, as the server does.
+// A legacy channel, named by the ID alone, needs no proof.
+func VerifyChannel(info *SelfInfo) error {
+	if !IsAuthenticatedChannel(info.ChanName) {
+		return nil
+	}
+	if info.Proof == nil {
+		return errors.New("missing channel proof")
+	}
+	if skew := time.Since(time.Unix(info.Proof.TS, 0)); skew > maxProofSkew || skew < -maxProofSkew {
+		return fmt.Errorf("stale channel proof (clock skew %v)", skew.Truncate(time.Second))
+	}
+	msg := proofMessage(info.ChanName, info.Proof.TS, info.PriAddr, info.Candidates, info.UDPAddrs, info.TSAddr, info.RelayNonce, info.Sealed)
+	return verifyProof(info.ChanName, msg, info.Proof)
+}
+
+// verifyPeer checks that the peer's info comes from someone with the same PSK.
+// The proof could be as old as the time the peer has waited, so its age is left to the server.
+func (info *PeerInfo) verifyPeer(self *SelfInfo) error {
+	if self.key == nil {
+		return nil
+	}
+	if info.Proof == nil || len(info.PeerAddrs) == 0 {
+		return errors.New("missing channel proof")
+	}
+	msg := proofMessage(self.ChanName, info.Proof.TS, info.PeerAddrs[0].PriAddr, info.Candidates, info.UDPAddrs, info.TSAddr, info.RelayNonce, info.Sealed)
+	return verifyProof(self.ChanName, msg, info.Proof)
+}
+
+func verifyProof(chanName string, msg []byte, proof *ChannelProof) error {
+	pub, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(chanName, channelPrefix))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("malformed channel name")
+	}
+	if !ed25519.Verify(pub, msg, proof.Sig) {
+		return errors.New("invalid channel proof")
+	}
+	return nil
+}
+
+// proofMessage is what a proof signs: the channel, the time, and everything the peer would connect to,
+// in the clear or sealed. Keep it in sync with edge/index.ts.
+func proofMessage(chanName string, ts int64, priAddr string, cands []Candidate, udpAddrs []string, tsAddr, relayNonce string, sealed []byte) []byte {
+	candAddrs := make([]string, len(cands))
+	for i, c := range cands {
+		candAddrs[i] = c.Addr
+	}
+	return []byte(strings.Join([]string{
+		"acp channel proof", chanName, strconv.FormatInt(ts, 10), priAddr,
+		strings.Join(candAddrs, ","), strings.Join(udpAddrs, ","), tsAddr, relayNonce,
+		base64.StdEncoding.EncodeToString(sealed), // as in JSON
+	}, "|"))
+}
@@ -0,0 +1,81 @@
+package pnet
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChannelProof(t *testing.T) {
+	var self SelfInfo
+	self.Authenticate("AAAAAAAA", []byte("psk"), false)
+	if !strings.HasPrefix(self.ChanName, channelPrefix) || strings.Contains(self.ChanName, "AAAAAAAA") {
+		t.Fatalf("unexpected channel name %q", self.ChanName)
+	}
+	self.PriAddr = "192.168.1.2:9000"
+	self.Candidates = []Candidate{{Addr: "192.168.1.2:9000", Kind: CandidateHost}, {Addr: "203.0.113.1:9000", Kind: CandidateMapped}}
+	self.RelayNonce = "nonce"
+	self.sign()
+	if err := VerifyChannel(&self); err != nil {
+		t.Fatalf("valid proof rejected: %v", err)
+	}
+
+	// As passed on by the server
+	peer := PeerInfo{
+		PeerAddrs:  []AddrPair{{PriAddr: self.PriAddr, PubAddr: "203.0.113.1:9000"}},
+		Candidates: self.Candidates,
+		RelayNonce: self.RelayNonce,
+		Proof:      self.Proof,
+	}
+	var other SelfInfo
+	other.Authenticate("AAAAAAAA", []byte("psk"), false)
+	if other.ChanName != self.ChanName {
+		t.Fatalf("channel names differ with the same PSK")
+	}
+	if err := peer.verifyPeer(&other); err != nil {
+		t.Fatalf("valid peer rejected: %v", err)
+	}
+	peer.Candidates = []Candidate{{Addr: "198.51.100.1:9000", Kind: CandidateHost}}
+	if err := peer.verifyPeer(&other); err == nil {
+		t.Errorf("tampered candidates accepted")
+	}
+
+	var stranger SelfInfo
+	stranger.Authenticate("AAAAAAAA", []byte("guess"), false)
+	stranger.ChanName = self.ChanName
+	stranger.sign()
+	if err := VerifyChannel(&stranger); err == nil {
+		t.Errorf("proof by a stranger accepted")
+	}
+	stranger.Proof = nil
+	if err := VerifyChannel(&stranger); err == nil {
+		t.Errorf("missing proof accepted")
+	}
+
+	stale := self
+	stale.Proof = &ChannelProof{TS: time.Now().Add(-time.Hour).Unix()}
+	if err := VerifyChannel(&stale); err == nil {
+		t.Errorf("stale proof accepted")
+	}
+	if err := VerifyChannel(&SelfInfo{ChanName: "AAAAAAAA"}); err != nil {
+		t.Errorf("legacy channel rejected: %v", err)
+	}
+}
+
+func TestLegacyChannel(t *testing.T) {
+	var self SelfInfo
+	self.Authenticate("AAAAAAAA", []byte("psk"), false)
+	self.UseLegacyChannel("AAAAAAAA")
+	self.PriAddr = "192.168.1.2:9000"
+	msg, err := self.seal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.sign()
+	if msg.ChanName != "AAAAAAAA" || msg.Proof != nil || msg.Sealed != nil || msg.PriAddr != self.PriAddr {
+		t.Fatalf("unexpected info on the legacy channel: %+v", *msg)
+	}
+	if err = VerifyChannel(msg); err != nil {
+		t.Errorf("legacy channel rejected: %v", err)
+	}
+}
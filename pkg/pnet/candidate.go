@@ -0,0 +1,182 @@
+package pnet
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// A peer gathers candidate addresses of both IP families for the rendezvous port, and the other
+// side tries them all, highest priority first, in a happy-eyeballs fashion. This way, two peers
+// connect as long as they share any reachable path, regardless of their preferred IP family.
+
+const (
+	CandidateHost   = "host"   // address of a local interface
+	CandidateMapped = "mapped" // port mapped on the router
+	CandidateSrflx  = "srflx"  // public address observed by the server
+
+	// Bonus priority for the family preferred by the config
+	preferredFamilyBonus = 5
+	// Bonus priority for the interface of the default route, among the host candidates of a family
+	defaultRouteBonus = 1
+	// Delay between starting attempts of successive candidates
+	candidateStagger = 50 * time.Millisecond
+	whoamiTimeout    = 2 * time.Second
+)
+
+var kindPriority = map[string]int{
+	CandidateHost:   120,
+	CandidateMapped: 100,
+	CandidateSrflx:  80,
+}
+
+// Candidate is an address at which the peer might reach us
+type Candidate struct {
+	Addr     string `json:"addr"`
+	Kind     string `json:"kind"`
+	Priority int    `json:"prio"`
+}
+
+// NewCandidate creates a candidate of the address, ranked by its kind and IP family
+func NewCandidate(addr netip.AddrPort, kind string, preferIPv6 bool) Candidate {
+	prio := kindPriority[kind]
+	if addr.Addr().Is6() == preferIPv6 {
+		prio += preferredFamilyBonus
+	}
+	return Candidate{Addr: addr.String(), Kind: kind, Priority: prio}
+}
+
+// GatherCandidates collects the addresses at which the peer might reach the local ports, in both
+// IP families: the addresses of all usable interfaces (see InterfaceAddrs for the excludes), and
+// the public addresses observed by the server, except the one of the first port in the family for
+// the exchange, which the server observes anyway.
+func GatherCandidates(ctx context.Context, whoamiURL string, ports []int, preferIPv6 bool, excludes []string) (cands []Candidate) {
+	addrs, err := InterfaceAddrs(excludes)
+	if err != nil {
+		defaultLogger.Debugf("%v", err)
+	}
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		srflx []Candidate
+	)
+	for _, v6 := range []bool{false, true} {
+		ip, err := OutboundIP(v6)
+		if err != nil {
+			defaultLogger.Debugf("no %s route: %v", tern(v6, "IPv6", "IPv4"), err)
+		}
+		for i, port := range ports {
+			for _, a := range addrs {
+				if a.Is6() != v6 {
+					continue
+				}
+				c := NewCandidate(netip.AddrPortFrom(a, uint16(port)), CandidateHost, preferIPv6)
+				if a == ip {
+					c.Priority += defaultRouteBonus
+				}
+				cands = append(cands, c)
+			}
+			if err != nil || (i == 0 && v6 == preferIPv6) {
+				continue
+			}
+			wg.Go(func() {
+				ctx, cancel := context.WithTimeout(ctx, whoamiTimeout)
+				defer cancel()
+				_, pub, err := whoami(ctx, whoamiURL, v6, fmt.Sprintf(":%d", port))
+				if err != nil {
+					defaultLogger.Debugf("failed to observe the public %s address of port %d: %v", tern(v6, "IPv6", "IPv4"), port, err)
+					return
+				}
+				if !slices.Contains(addrs, pub.Addr()) {
+					mu.Lock()
+					srflx = append(srflx, NewCandidate(pub, CandidateSrflx, preferIPv6))
+					mu.Unlock()
+				}
+			})
+		}
+	}
+	wg.Wait()
+	return append(cands, srflx...)
+}
+
+// CandidatesOf lists the peer's candidates from the exchange, sorted by priority.
+// The addresses observed by the server rank as if the peer advertised them.
+func CandidatesOf(info *PeerInfo, preferIPv6 bool) []Candidate {
+	var cands []Candidate
+	for _, ap := range info.PeerAddrs {
+		for kind, addr := range map[string]string{CandidateHost: ap.PriAddr, CandidateSrflx: ap.PubAddr} {
+			if a, err := netip.ParseAddrPort(addr); err == nil {
+				cands = append(cands, NewCandidate(unmapAddrPort(a), kind, preferIPv6))
+			}
+		}
+	}
+	cands = append(cands, info.Candidates...)
+	return rankCandidates(cands)
+}
+
+// rankCandidates sorts the candidates by descending priority, removing duplicated addresses
+func rankCandidates(cands []Candidate) []Candidate {
+	slices.SortStableFunc(cands, func(a, b Candidate) int {
+		return cmp.Or(cmp.Compare(b.Priority, a.Priority), cmp.Compare(a.Addr, b.Addr))
+	})
+	seen := make(map[string]bool)
+	return slices.DeleteFunc(cands, func(c Candidate) bool {
+		dup := seen[c.Addr]
+		seen[c.Addr] = true
+		return dup
+	})
+}
+
+// Roles in settling on one connection, when several pairs of addresses race (see RendezvousOptions)
+const (
+	// Only one pair races, where a simultaneous opening yields the same connection on both sides
+	NominationNone = iota
+	// Pick the first connection, and tell the peer
+	NominationControlling
+	// Follow the peer's pick
+	NominationControlled
+)
+
+// RendezvousOptions bounds a rendezvous and decides how both sides agree on the connection
+type RendezvousOptions struct {
+	// Time budget in total, and for each pair of local port and peer address
+	Timeout, AttemptTimeout time.Duration
+	// With several pairs racing, both sides might get different connections first,
+	// so one side nominates its pick, and the other side follows
+	Nomination int
+}
+
+// RendezvousCandidates performs simultaneous connection opening for TCP hole punching from each
+// of the local ports in laddrs towards each of the candidates, all at once, settling on one connection.
+func RendezvousCandidates(ctx context.Context, laddrs []string, cands []Candidate, opts RendezvousOptions) (conn net.Conn, err error) {
+	ctx1, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+	conn, err = rendezvous(ctx1, laddrs, cands, opts)
+	if err != nil {
+		if errors.Is(ctx1.Err(), context.DeadlineExceeded) {
+			defaultLogger.Infof("rendezvous timeout for %v -> %v", laddrs, cands)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// localAddrFor picks the local address for reaching raddr: the port of laddr on the wildcard address
+// of the family of raddr, so that the candidates of every interface are reachable, and the route to
+// raddr picks the source address
+func localAddrFor(laddr netip.AddrPort, raddr netip.AddrPort) (network string, local string) {
+	if raddr.Addr().Is4() {
+		return "tcp4", fmt.Sprintf("0.0.0.0:%d", laddr.Port())
+	}
+	return "tcp6", fmt.Sprintf("[::]:%d", laddr.Port())
+}
+
+func unmapAddrPort(a netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(a.Addr().Unmap(), a.Port())
+}
@@ -0,0 +1,141 @@
+package pnet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestCandidatesOf(t *testing.T) {
+	info := &PeerInfo{
+		PeerAddrs: []AddrPair{{PriAddr: "192.168.1.2:9000", PubAddr: "1.2.3.4:9000"}},
+		Candidates: []Candidate{
+			NewCandidate(netip.MustParseAddrPort("[2001:db8::2]:9000"), CandidateHost, true),
+			NewCandidate(netip.MustParseAddrPort("1.2.3.4:9000"), CandidateMapped, true), // same as the observed one
+		},
+	}
+	var got []string
+	for _, c := range CandidatesOf(info, false) {
+		got = append(got, c.Addr)
+	}
+	expect := []string{"192.168.1.2:9000", "[2001:db8::2]:9000", "1.2.3.4:9000"}
+	if fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Fatalf("unexpected candidates: expect: %v, got: %v", expect, got)
+	}
+}
+
+func TestRendezvousAcrossFamilies(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("IPv6 loopback not available")
+	} else {
+		_ = l.Close()
+	}
+	defaultLogger = &testLogger{t}
+	portA, _ := FreePort(false)
+	portB, _ := FreePort(true)
+	// A exchanged over IPv4 and B over IPv6, while both advertise the other family as well
+	laddrA, laddrB := fmt.Sprintf("127.0.0.1:%d", portA), fmt.Sprintf("[::1]:%d", portB)
+	candsOfB := []Candidate{{Addr: fmt.Sprintf("127.0.0.1:%d", portB+1)}, {Addr: laddrB}} // the first is unreachable
+	candsOfA := []Candidate{{Addr: fmt.Sprintf("[::1]:%d", portA)}}
+
+	chErr := make(chan error, 1)
+	go func() {
+		conn, err := RendezvousCandidates(context.Background(), []string{laddrA}, candsOfB, RendezvousOptions{Timeout: rendezvousTimeout, AttemptTimeout: rendezvousTimeout})
+		if err == nil {
+			_ = conn.Close()
+		}
+		chErr <- err
+	}()
+	conn, err := RendezvousCandidates(context.Background(), []string{laddrB}, candsOfA, RendezvousOptions{Timeout: rendezvousTimeout, AttemptTimeout: rendezvousTimeout})
+	if err != nil {
+		t.Fatalf("rendezvous from B failed: %v", err)
+	}
+	_ = conn.Close()
+	if err = <-chErr; err != nil {
+		t.Fatalf("rendezvous from A failed: %v", err)
+	}
+}
+
+func TestRendezvousNonPrimaryAddr(t *testing.T) {
+	if l, err := net.Listen("tcp4", "127.0.0.2:0"); err != nil {
+		t.Skip("127.0.0.2 not available")
+	} else {
+		_ = l.Close()
+	}
+	defaultLogger = &testLogger{t}
+	portA, _ := FreePort(false)
+	portB, _ := FreePort(false)
+	// A exchanged from 127.0.0.1, while B only gets through to the other address advertised by A
+	laddrA, laddrB := fmt.Sprintf("127.0.0.1:%d", portA), fmt.Sprintf("127.0.0.1:%d", portB)
+	candsOfA := []Candidate{{Addr: fmt.Sprintf("127.0.0.2:%d", portA)}}
+	candsOfB := []Candidate{{Addr: fmt.Sprintf("127.0.0.1:%d", portB+1)}} // unreachable
+
+	chErr := make(chan error, 1)
+	go func() {
+		conn, err := RendezvousCandidates(context.Background(), []string{laddrA}, candsOfB, RendezvousOptions{Timeout: rendezvousTimeout, AttemptTimeout: rendezvousTimeout})
+		if err == nil {
+			_ = conn.Close()
+		}
+		chErr <- err
+	}()
+	conn, err := RendezvousCandidates(context.Background(), []string{laddrB}, candsOfA, RendezvousOptions{Timeout: rendezvousTimeout, AttemptTimeout: rendezvousTimeout})
+	if err != nil {
+		t.Fatalf("rendezvous from B failed: %v", err)
+	}
+	_ = conn.Close()
+	if err = <-chErr; err != nil {
+		t.Fatalf("rendezvous from A failed: %v", err)
+	}
+}
+
+func TestRendezvousMultiplePorts(t *testing.T) {
+	defaultLogger = &testLogger{t}
+	var ports [4]int
+	for i := range ports {
+		ports[i], _ = FreePort(false)
+	}
+	addr := func(port int) string { return fmt.Sprintf("127.0.0.1:%d", port) }
+	// Every pair connects on loopback, while only the second port of B is in use
+	laddrsA, laddrsB := []string{addr(ports[0]), addr(ports[1])}, []string{addr(ports[3])}
+	candsOfA := []Candidate{{Addr: addr(ports[0])}, {Addr: addr(ports[1])}}
+	candsOfB := []Candidate{{Addr: addr(ports[2])}, {Addr: addr(ports[3])}}
+
+	chConn := make(chan net.Conn, 1)
+	go func() {
+		conn, err := RendezvousCandidates(context.Background(), laddrsA, candsOfB, RendezvousOptions{
+			Timeout: time.Second, AttemptTimeout: time.Second, Nomination: NominationControlling,
+		})
+		if err != nil {
+			t.Errorf("rendezvous from A failed: %v", err)
+		}
+		chConn <- conn
+	}()
+	connB, err := RendezvousCandidates(context.Background(), laddrsB, candsOfA, RendezvousOptions{
+		Timeout: time.Second, AttemptTimeout: time.Second, Nomination: NominationControlled,
+	})
+	if err != nil {
+		t.Fatalf("rendezvous from B failed: %v", err)
+	}
+	defer func() { _ = connB.Close() }()
+	connA := <-chConn
+	if connA == nil {
+		t.FailNow()
+	}
+	defer func() { _ = connA.Close() }()
+	if connA.LocalAddr().String() != connB.RemoteAddr().String() || connA.RemoteAddr().String() != connB.LocalAddr().String() {
+		t.Fatalf("both sides settled on different connections: A %v->%v, B %v->%v",
+			connA.LocalAddr(), connA.RemoteAddr(), connB.LocalAddr(), connB.RemoteAddr())
+	}
+
+	// Without a peer, the rendezvous gives up once every attempt has run out of its budget
+	start := time.Now()
+	_, err = RendezvousCandidates(context.Background(), laddrsA, candsOfB[:1], RendezvousOptions{
+		Timeout: 5 * time.Second, AttemptTimeout: 200 * time.Millisecond, Nomination: NominationControlled,
+	})
+	if err == nil || time.Since(start) > time.Second {
+		t.Fatalf("expect to give up after the attempt budget, got %v after %v", err, time.Since(start))
+	}
+}
@@ -0,0 +1,23 @@
+package pnet
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// DefaultGateway returns the IPv4 address of the default gateway, i.e. the router we are behind.
+// If the routing table is not accessible, it guesses the first host of the LAN subnet.
+func DefaultGateway() (netip.Addr, error) {
+	gw, err := routeGateway()
+	if err == nil {
+		return gw, nil
+	}
+	defaultLogger.Debugf("failed to read default gateway from routing table: %v", err)
+	ip, err := LANIP(false)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to find default gateway: %w", err)
+	}
+	b := ip.As4()
+	b[3] = 1
+	return netip.AddrFrom4(b), nil
+}
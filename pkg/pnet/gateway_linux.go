@@ -0,0 +1,49 @@
+package pnet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const rtfGateway = 0x2
+
+func routeGateway() (netip.Addr, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer func() { _ = f.Close() }()
+	return parseProcNetRoute(f)
+}
+
+// parseProcNetRoute finds the default route in the format of /proc/net/route, where
+// addresses are hex-encoded in host byte order
+func parseProcNetRoute(f io.Reader) (netip.Addr, error) {
+	sc := bufio.NewScanner(f)
+	sc.Scan() // header
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 4 || fields[1] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil || flags&rtfGateway == 0 {
+			continue
+		}
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 4 {
+			continue
+		}
+		var ip [4]byte
+		binary.BigEndian.PutUint32(ip[:], binary.LittleEndian.Uint32(b))
+		return netip.AddrFrom4(ip), nil
+	}
+	return netip.Addr{}, errors.New("no default route")
+}
@@ -0,0 +1,20 @@
+package pnet
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseProcNetRoute(t *testing.T) {
+	table := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0000A8C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+eth0	00000000	0100A8C0	0003	0	0	100	00000000	0	0	0
+`
+	gw, err := parseProcNetRoute(strings.NewReader(table))
+	if err != nil {
+		t.Fatalf("failed to parse route table: %v", err)
+	}
+	if gw.String() != "192.168.0.1" {
+		t.Fatalf("unexpected gateway: expect: 192.168.0.1, got: %v", gw)
+	}
+}
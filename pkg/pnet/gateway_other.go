@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package pnet
+
+import (
+	"errors"
+	"net/netip"
+)
+
+func routeGateway() (netip.Addr, error) {
+	return netip.Addr{}, errors.New("reading the routing table is not supported on this platform")
+}
@@ -4,11 +4,13 @@ import (
 	"context"
 	"net"
 	"net/http"
+	"sync/atomic"
 )
 
 type HTTPClient struct {
 	*http.Client
 	chLaddr chan net.Addr
+	conn    atomic.Pointer[net.Conn]
 }
 
 func NewHTTPClient(useIpv6 bool, laddr string) *HTTPClient {
@@ -18,13 +20,19 @@ func NewHTTPClient(useIpv6 bool, laddr string) *HTTPClient {
 	}
 
 	tr := http.DefaultTransport.(*http.Transport).Clone()
-	tr.DialContext = func(ctx context.Context, _network, addr string) (net.Conn, error) {
+	tr.Proxy = nil // handled by DialUpstream, which tunnels through the proxy
+	tr.DialContext = func(ctx context.Context, _network, addr string) (c net.Conn, err error) {
 		network := "tcp4"
 		if useIpv6 {
 			network = "tcp6"
 		}
-		c, err := DialContext(ctx, network, laddr, addr)
+		if Proxied() { // the local address is irrelevant, as hole punching is out of the question
+			c, err = DialUpstream(ctx, "tcp", addr)
+		} else {
+			c, err = DialContext(ctx, network, laddr, addr)
+		}
 		if err == nil {
+			client.conn.Store(&c)
 			client.chLaddr <- c.LocalAddr()
 		} else {
 			defaultLogger.Debugf("pnet.HTTPClient.Transport.DialContext: %v", err)
@@ -39,3 +47,14 @@ func NewHTTPClient(useIpv6 bool, laddr string) *HTTPClient {
 func (cl *HTTPClient) GetLAddr() <-chan net.Addr {
 	return cl.chLaddr
 }
+
+// Discard closes the connection with a reset, instead of keeping it idle or leaving it in TIME_WAIT,
+// either of which would block the same local port from connecting to the server again for a while
+func (cl *HTTPClient) Discard() {
+	if c := cl.conn.Load(); c != nil {
+		if tc, ok := (*c).(*net.TCPConn); ok {
+			_ = tc.SetLinger(0)
+		}
+	}
+	cl.CloseIdleConnections()
+}
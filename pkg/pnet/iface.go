@@ -0,0 +1,74 @@
+package pnet
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Name patterns of virtual interfaces, which are not reachable by the peer on another machine,
+// or are covered by dedicated dialers (e.g. Tailscale)
+var virtualInterfaces = []string{
+	"docker*", "br-*", "veth*", "virbr*", "vmnet*", "vboxnet*", "cni*", "flannel*", "podman*", "lxc*", "lxdbr*",
+	"tailscale*", "zt*", "utun*", "awdl*", "llw*", "anpi*", "gif*", "stf*",
+}
+
+// InterfaceAddrs lists the usable unicast addresses of all interfaces that are up, except loopback,
+// virtual ones, and the ones matching any of the excludes. An exclude is either a glob pattern of
+// interface names (e.g. "wg*"), or an address prefix (e.g. "10.8.0.0/16").
+func InterfaceAddrs(excludes []string) ([]netip.Addr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %w", err)
+	}
+	var res []netip.Addr
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || excludedName(iface.Name, excludes) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			defaultLogger.Debugf("failed to list addresses of %s: %v", iface.Name, err)
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip, ok := netip.AddrFromSlice(ipnet.IP); ok && usableAddr(ip.Unmap(), excludes) {
+				res = append(res, ip.Unmap())
+			}
+		}
+	}
+	return res, nil
+}
+
+func excludedName(name string, excludes []string) bool {
+	for _, pattern := range slices.Concat(virtualInterfaces, excludes) {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// usableAddr tells whether the peer could possibly reach the address from another machine
+func usableAddr(ip netip.Addr, excludes []string) bool {
+	// Link-local addresses are ambiguous without a zone, which differs between machines
+	if !ip.IsGlobalUnicast() || ip.IsLinkLocalUnicast() {
+		return false
+	}
+	for _, ex := range excludes {
+		if !strings.Contains(ex, "/") {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(ex); err == nil && prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,36 @@
+package pnet
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestInterfaceFilter(t *testing.T) {
+	excludes := []string{"wg*", "10.8.0.0/16"}
+	for name, expect := range map[string]bool{
+		"eth0":    false,
+		"en0":     false,
+		"docker0": true,
+		"veth1a2": true,
+		"utun3":   true,
+		"wg0":     true,
+	} {
+		if got := excludedName(name, excludes); got != expect {
+			t.Errorf("interface %s: expect excluded=%v, got %v", name, expect, got)
+		}
+	}
+	for addr, expect := range map[string]bool{
+		"192.168.1.2": true,
+		"2001:db8::2": true,
+		"10.8.1.1":    false,
+		"10.9.1.1":    true,
+		"127.0.0.1":   false,
+		"169.254.1.1": false,
+		"fe80::1":     false,
+		"224.0.0.251": false,
+	} {
+		if got := usableAddr(netip.MustParseAddr(addr), excludes); got != expect {
+			t.Errorf("address %s: expect usable=%v, got %v", addr, expect, got)
+		}
+	}
+}
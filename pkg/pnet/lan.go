@@ -0,0 +1,214 @@
+package pnet
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// LAN discovery exchanges connection info with a peer on the same link via multicast,
+// without involving the rendezvous server.
+//
+// Each side keeps announcing its info to the multicast group, until it has heard a peer
+// that has also heard it. Announcements carry an HMAC under the PSK, so that a stranger
+// on the LAN can neither learn the channel ID nor pose as one of our devices.
+
+const (
+	lanGroup4            = "239.255.77.77:47913"
+	lanGroup6            = "[ff02::77:77]:47913"
+	lanAnnounceInterval  = 300 * time.Millisecond
+	lanFinalAnnouncement = 3 // sent at the regular interval after the peer is found, in case it misses the first
+	lanMaxClockSkew      = 30 * time.Second
+)
+
+type lanAnnouncement struct {
+	Chan  string   `json:"chan"`
+	Nonce string   `json:"nonce"`
+	Seen  string   `json:"seen,omitempty"` // the nonce of the peer we have heard
+	TS    int64    `json:"ts"`
+	Info  SelfInfo `json:"info"`
+	MAC   string   `json:"mac,omitempty"`
+}
+
+// DiscoverLAN exchanges oneself's info for the info of a peer with the same id on the LAN
+func DiscoverLAN(ctx context.Context, info *SelfInfo, psk []byte, port int, useIPv6 bool) (*PeerInfo, error) {
+	group, err := net.ResolveUDPAddr(tern(useIPv6, "udp6", "udp4"), tern(useIPv6, lanGroup6, lanGroup4))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP(tern(useIPv6, "udp6", "udp4"), nil, group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join LAN multicast group: %w", err)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	defer func() { _ = conn.Close() }()
+	ip, err := LANIP(useIPv6)
+	if err != nil {
+		return nil, err
+	}
+	// A separate socket for sending, as multicast loopback is disabled on the listening one,
+	// and we want to reach peers on the same host as well
+	sendConn, err := net.ListenUDP(tern(useIPv6, "udp6", "udp4"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up LAN multicast: %w", err)
+	}
+
+	info.PriAddr = netip.AddrPortFrom(ip, uint16(port)).String()
+	key := lanKey(psk)
+	self := lanAnnouncement{
+		Chan:  lanChannel(key, info.ChanName),
+		Nonce: randHex(8),
+		Info:  *info,
+	}
+	self.Info.ChanName = "" // the channel is identified by the tag instead
+
+	var mu sync.Mutex // guards self
+	announce := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		self.TS = time.Now().Unix()
+		self.MAC = ""
+		self.MAC = lanMAC(key, &self)
+		b, _ := json.Marshal(&self)
+		_, _ = sendConn.WriteToUDP(b, group)
+	}
+	chFound := make(chan struct{})
+	go func() {
+		defer func() { _ = sendConn.Close() }()
+		ticker := time.NewTicker(lanAnnounceInterval)
+		defer ticker.Stop()
+		for {
+			announce()
+			select {
+			case <-ticker.C:
+				continue
+			case <-ctx.Done(): // most likely cancelled right after we found the peer
+			case <-chFound:
+			}
+			select {
+			case <-chFound:
+			default:
+				return
+			}
+			// The peer might still be waiting to hear that we have heard it, which a single
+			// lost packet would deny; keep announcing for a while, even if we are done
+			for range lanFinalAnnouncement {
+				<-ticker.C
+				announce()
+			}
+			return
+		}
+	}()
+
+	defaultLogger.Infof("looking for peer on LAN...")
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, context.Canceled
+			}
+			return nil, fmt.Errorf("LAN discovery: %w", err)
+		}
+		var peer lanAnnouncement
+		if json.Unmarshal(buf[:n], &peer) != nil || peer.Nonce == self.Nonce || peer.Chan != self.Chan {
+			continue
+		}
+		if err = verifyLANAnnouncement(key, &peer); err != nil {
+			defaultLogger.Debugf("ignore LAN announcement from %v: %v", from, err)
+			continue
+		}
+		mu.Lock()
+		if self.Seen == "" {
+			defaultLogger.Debugf("heard peer on LAN at %v", from)
+		}
+		self.Seen = peer.Nonce // picked up by the next announcement
+		mu.Unlock()
+		if peer.Seen != self.Nonce {
+			continue
+		}
+		close(chFound)
+		return peerInfoOf(info.PriAddr, peer.Info, peer.Info.PriAddr), nil
+	}
+}
+
+func verifyLANAnnouncement(key []byte, a *lanAnnouncement) error {
+	mac := a.MAC
+	a.MAC = ""
+	if !hmac.Equal([]byte(mac), []byte(lanMAC(key, a))) {
+		return errors.New("invalid MAC")
+	}
+	if skew := time.Since(time.Unix(a.TS, 0)); skew > lanMaxClockSkew || skew < -lanMaxClockSkew {
+		return fmt.Errorf("stale announcement (clock skew %v)", skew)
+	}
+	return nil
+}
+
+func lanKey(psk []byte) []byte {
+	mac := hmac.New(sha256.New, psk)
+	mac.Write([]byte("acp lan discovery"))
+	return mac.Sum(nil)
+}
+
+func lanChannel(key []byte, id string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("channel|" + id))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func lanMAC(key []byte, a *lanAnnouncement) string {
+	b, _ := json.Marshal(a)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// LANIP returns the local IP address for reaching the LAN.
+// It falls back to the first private address found if there is no route to the internet.
+func LANIP(useIPv6 bool) (netip.Addr, error) {
+	if ip, err := OutboundIP(useIPv6); err == nil {
+		return ip, nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to list interface addresses: %w", err)
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipnet.IP)
+		if ip = ip.Unmap(); ok && ip.Is4() != useIPv6 && ip.IsPrivate() {
+			return ip, nil
+		}
+	}
+	return netip.Addr{}, errors.New("no LAN address found")
+}
+
+// FreePort finds an available TCP port for binding
+func FreePort(useIPv6 bool) (int, error) {
+	l, err := Listen(context.Background(), tern(useIPv6, "tcp6", "tcp4"), ":0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port: %w", err)
+	}
+	defer func() { _ = l.Close() }()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func randHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
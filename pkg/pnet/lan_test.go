@@ -0,0 +1,41 @@
+package pnet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerifyLANAnnouncement(t *testing.T) {
+	key := lanKey([]byte("test-psk"))
+	newAnnouncement := func() lanAnnouncement {
+		a := lanAnnouncement{
+			Chan:  lanChannel(key, "test-lan"),
+			Nonce: "0123456789abcdef",
+			TS:    time.Now().Unix(),
+			Info:  SelfInfo{PriAddr: "192.168.1.2:9527"},
+		}
+		a.MAC = lanMAC(key, &a)
+		return a
+	}
+
+	a := newAnnouncement()
+	if err := verifyLANAnnouncement(key, &a); err != nil {
+		t.Fatalf("valid announcement rejected: %v", err)
+	}
+	a = newAnnouncement()
+	if err := verifyLANAnnouncement(lanKey([]byte("other-psk")), &a); err == nil {
+		t.Fatalf("announcement under a different PSK accepted")
+	}
+	a = newAnnouncement()
+	a.Info.PriAddr = "192.168.1.3:9527"
+	if err := verifyLANAnnouncement(key, &a); err == nil {
+		t.Fatalf("tampered announcement accepted")
+	}
+	a = newAnnouncement()
+	a.TS -= 3600
+	a.MAC = ""
+	a.MAC = lanMAC(key, &a)
+	if err := verifyLANAnnouncement(key, &a); err == nil {
+		t.Fatalf("stale announcement accepted")
+	}
+}
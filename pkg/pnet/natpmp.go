@@ -0,0 +1,247 @@
+package pnet
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Minimal clients of NAT-PMP (RFC 6886) and its successor PCP (RFC 6887), which share
+// the same port on the router. Only mapping an inbound port is supported.
+
+const (
+	natPMPPort         = 5351
+	natPMPVersion      = 0
+	pcpVersion         = 2
+	natPMPInitialDelay = 250 * time.Millisecond
+	natPMPTimeout      = 2 * time.Second
+
+	natPMPOpExternalAddr = 0
+	natPMPOpMapUDP       = 1
+	natPMPOpMapTCP       = 2
+	pcpOpAnnounce        = 0
+	pcpOpMap             = 1
+	opResponse           = 0x80
+
+	pcpHeaderLen = 24
+	pcpMapLen    = 36
+)
+
+var (
+	natPMPResults = []string{"success", "unsupported version", "not authorized", "network failure", "out of resources", "unsupported opcode"}
+	pcpResults    = []string{"success", "unsupported version", "not authorized", "malformed request", "unsupported opcode",
+		"unsupported option", "malformed option", "network failure", "out of resources", "unsupported protocol",
+		"user exceeded quota", "cannot provide external", "address mismatch", "excessive remote peers"}
+)
+
+type natPMPClient struct {
+	gateway netip.AddrPort
+	extIP   netip.Addr
+}
+
+func (c *natPMPClient) String() string { return "NAT-PMP" }
+
+// probe asks for the external address, which also tells whether the router speaks NAT-PMP
+func (c *natPMPClient) probe(ctx context.Context) error {
+	resp, err := roundTrip(ctx, c.gateway, []byte{natPMPVersion, natPMPOpExternalAddr}, natPMPVersion, natPMPOpExternalAddr)
+	if err != nil {
+		return err
+	}
+	if err = resultErr(binary.BigEndian.Uint16(resp[2:]), natPMPResults); err != nil {
+		return fmt.Errorf("NAT-PMP: %w", err)
+	}
+	if len(resp) < 12 {
+		return errors.New("NAT-PMP: truncated response")
+	}
+	c.extIP = netip.AddrFrom4([4]byte(resp[8:12]))
+	return nil
+}
+
+func (c *natPMPClient) AddPortMapping(ctx context.Context, protocol string, port uint16, lifetime time.Duration) (netip.AddrPort, error) {
+	if !c.extIP.IsValid() {
+		if err := c.probe(ctx); err != nil {
+			return netip.AddrPort{}, err
+		}
+	}
+	extPort, err := c.mapRequest(ctx, protocol, port, port, lifetime)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(c.extIP, extPort), nil
+}
+
+func (c *natPMPClient) DeletePortMapping(ctx context.Context, protocol string, port uint16) error {
+	_, err := c.mapRequest(ctx, protocol, port, 0, 0)
+	return err
+}
+
+// mapRequest maps the internal port for the lifetime (or deletes the mapping if lifetime is 0),
+// returning the assigned external port
+func (c *natPMPClient) mapRequest(ctx context.Context, protocol string, port uint16, extPort uint16, lifetime time.Duration) (uint16, error) {
+	op := byte(tern(strings.EqualFold(protocol, "udp"), natPMPOpMapUDP, natPMPOpMapTCP))
+	req := make([]byte, 12)
+	req[0], req[1] = natPMPVersion, op
+	binary.BigEndian.PutUint16(req[4:], port)
+	binary.BigEndian.PutUint16(req[6:], extPort)
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime.Seconds()))
+	resp, err := roundTrip(ctx, c.gateway, req, natPMPVersion, op)
+	if err != nil {
+		return 0, err
+	}
+	if err = resultErr(binary.BigEndian.Uint16(resp[2:]), natPMPResults); err != nil {
+		return 0, fmt.Errorf("NAT-PMP: %w", err)
+	}
+	if len(resp) < 16 {
+		return 0, errors.New("NAT-PMP: truncated response")
+	}
+	return binary.BigEndian.Uint16(resp[10:]), nil
+}
+
+type pcpClient struct {
+	gateway netip.AddrPort
+	// The nonce identifying the mapping of each port, to be reused for renewal and deletion
+	nonces map[uint16][]byte
+}
+
+func (c *pcpClient) String() string { return "PCP" }
+
+// probe sends an ANNOUNCE, to which a PCP server answers with success
+func (c *pcpClient) probe(ctx context.Context) error {
+	_, err := c.request(ctx, pcpOpAnnounce, 0, nil)
+	return err
+}
+
+func (c *pcpClient) AddPortMapping(ctx context.Context, protocol string, port uint16, lifetime time.Duration) (netip.AddrPort, error) {
+	return c.mapRequest(ctx, protocol, port, lifetime)
+}
+
+func (c *pcpClient) DeletePortMapping(ctx context.Context, protocol string, port uint16) error {
+	_, err := c.mapRequest(ctx, protocol, port, 0)
+	return err
+}
+
+// mapRequest maps the internal port for the lifetime (or deletes the mapping if lifetime is 0),
+// returning the assigned external endpoint
+func (c *pcpClient) mapRequest(ctx context.Context, protocol string, port uint16, lifetime time.Duration) (netip.AddrPort, error) {
+	if c.nonces == nil {
+		c.nonces = make(map[uint16][]byte)
+	}
+	nonce, ok := c.nonces[port]
+	if !ok {
+		nonce = make([]byte, 12)
+		_, _ = rand.Read(nonce)
+		c.nonces[port] = nonce
+	}
+	body := make([]byte, pcpMapLen)
+	copy(body, nonce)
+	body[12] = byte(tern(strings.EqualFold(protocol, "udp"), 17, 6))
+	binary.BigEndian.PutUint16(body[16:], port)
+	binary.BigEndian.PutUint16(body[18:], port)
+	// Leave the suggested external address as all zeros, i.e. no preference
+	resp, err := c.request(ctx, pcpOpMap, lifetime, body)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	mapped := resp[pcpHeaderLen:]
+	if len(mapped) < pcpMapLen || string(mapped[:12]) != string(nonce) {
+		return netip.AddrPort{}, errors.New("PCP: mismatched MAP response")
+	}
+	if lifetime == 0 {
+		delete(c.nonces, port)
+	}
+	extIP := netip.AddrFrom16([16]byte(mapped[20:36])).Unmap()
+	return netip.AddrPortFrom(extIP, binary.BigEndian.Uint16(mapped[18:])), nil
+}
+
+func (c *pcpClient) request(ctx context.Context, op byte, lifetime time.Duration, body []byte) ([]byte, error) {
+	clientIP, err := localAddrTo(c.gateway)
+	if err != nil {
+		return nil, err
+	}
+	req := make([]byte, pcpHeaderLen, pcpHeaderLen+len(body))
+	req[0], req[1] = pcpVersion, op
+	binary.BigEndian.PutUint32(req[4:], uint32(lifetime.Seconds()))
+	ip16 := clientIP.As16()
+	copy(req[8:], ip16[:])
+	req = append(req, body...)
+	resp, err := roundTrip(ctx, c.gateway, req, pcpVersion, op)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < pcpHeaderLen {
+		return nil, errors.New("PCP: truncated response")
+	}
+	if err = resultErr(uint16(resp[3]), pcpResults); err != nil {
+		return nil, fmt.Errorf("PCP: %w", err)
+	}
+	return resp, nil
+}
+
+// roundTrip sends req to the gateway and waits for the response to the opcode,
+// retransmitting with exponential backoff
+func roundTrip(ctx context.Context, gateway netip.AddrPort, req []byte, version byte, op byte) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(gateway))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	ctx, cancel := context.WithTimeout(ctx, natPMPTimeout)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	go func() {
+		for delay := natPMPInitialDelay; ; delay *= 2 {
+			_, _ = conn.Write(req)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 1100) // the max size of a PCP message
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("no response from %v", gateway)
+			}
+			return nil, err
+		}
+		if n < 4 || buf[1] != op|opResponse {
+			continue
+		}
+		if buf[0] != version {
+			// e.g. a NAT-PMP-only router answering a PCP request, or vice versa
+			return nil, fmt.Errorf("gateway %v speaks a different protocol version %d", gateway, buf[0])
+		}
+		return buf[:n], nil
+	}
+}
+
+func resultErr(code uint16, names []string) error {
+	if code == 0 {
+		return nil
+	}
+	if int(code) < len(names) {
+		return errors.New(names[code])
+	}
+	return fmt.Errorf("result code %d", code)
+}
+
+// localAddrTo returns the local IP address for reaching the destination
+func localAddrTo(dst netip.AddrPort) (netip.Addr, error) {
+	c, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(dst))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer func() { _ = c.Close() }()
+	return c.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
@@ -0,0 +1,103 @@
+package pnet
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+var mockExtIP = netip.MustParseAddr("203.0.113.7")
+
+// mockNATGateway answers NAT-PMP (if pmp) or PCP requests, mapping port p to p+1000
+func mockNATGateway(t *testing.T, pmp bool) netip.AddrPort {
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start mock gateway: %v", err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+	go func() {
+		buf := make([]byte, 1100)
+		for {
+			n, from, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := buf[:n]
+			var rsp []byte
+			switch {
+			case req[0] != tern[byte](pmp, natPMPVersion, pcpVersion): // unsupported version
+				rsp = []byte{tern[byte](pmp, natPMPVersion, pcpVersion), req[1] | opResponse, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+			case pmp && req[1] == natPMPOpExternalAddr:
+				rsp = make([]byte, 12)
+				rsp[1] = opResponse
+				ip := mockExtIP.As4()
+				copy(rsp[8:], ip[:])
+			case pmp:
+				rsp = make([]byte, 16)
+				rsp[1] = req[1] | opResponse
+				copy(rsp[8:10], req[4:6])
+				binary.BigEndian.PutUint16(rsp[10:], binary.BigEndian.Uint16(req[4:])+1000)
+				copy(rsp[12:], req[8:12])
+			default:
+				rsp = make([]byte, len(req))
+				rsp[0], rsp[1] = pcpVersion, req[1]|opResponse
+				copy(rsp[pcpHeaderLen:], req[pcpHeaderLen:])
+				if req[1] == pcpOpMap {
+					body := rsp[pcpHeaderLen:]
+					binary.BigEndian.PutUint16(body[18:], binary.BigEndian.Uint16(body[16:])+1000)
+					ip := netip.AddrFrom16(mockExtIP.As16()).As16()
+					copy(body[20:], ip[:])
+					body[30], body[31] = 0xff, 0xff // IPv4-mapped
+				}
+			}
+			_, _ = server.WriteTo(rsp, from)
+		}
+	}()
+	return server.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func TestNATPMP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := &natPMPClient{gateway: mockNATGateway(t, true)}
+	if err := c.probe(ctx); err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	ext, err := c.AddPortMapping(ctx, "TCP", 4000, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to add port mapping: %v", err)
+	}
+	if expect := netip.AddrPortFrom(mockExtIP, 5000); ext != expect {
+		t.Fatalf("unexpected external endpoint: expect: %v, got: %v", expect, ext)
+	}
+
+	pcp := &pcpClient{gateway: c.gateway}
+	if err = pcp.probe(ctx); err == nil || !strings.Contains(err.Error(), "different protocol version") {
+		t.Fatalf("expect PCP probe to fail on a NAT-PMP gateway, got: %v", err)
+	}
+}
+
+func TestPCP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := &pcpClient{gateway: mockNATGateway(t, false)}
+	if err := c.probe(ctx); err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	ext, err := c.AddPortMapping(ctx, "TCP", 4000, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to add port mapping: %v", err)
+	}
+	if expect := netip.AddrPortFrom(mockExtIP, 5000); ext != expect {
+		t.Fatalf("unexpected external endpoint: expect: %v, got: %v", expect, ext)
+	}
+
+	pmp := &natPMPClient{gateway: c.gateway}
+	if err = pmp.probe(ctx); err == nil {
+		t.Fatal("expect NAT-PMP probe to fail on a PCP gateway")
+	}
+}
@@ -1,7 +1,9 @@
 package pnet
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -9,7 +11,10 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -30,24 +35,55 @@ type (
 	}
 
 	SelfInfo struct {
-		PriAddr  string   `json:"priAddr"`
-		ChanName string   `json:"chanName"`
-		Strategy []string `json:"strategy,omitempty"`
-		NPlan    int      `json:"nPlan,omitempty"`
-		TSAddr   string   `json:"tsAddr,omitempty"`
-		TSCap    uint     `json:"tsCap,omitempty"`
+		PriAddr    string        `json:"priAddr"`
+		ChanName   string        `json:"chanName"`
+		Strategy   []string      `json:"strategy,omitempty"`
+		NPlan      int           `json:"nPlan,omitempty"`
+		TSAddr     string        `json:"tsAddr,omitempty"`
+		TSCap      uint          `json:"tsCap,omitempty"`
+		UDPAddrs   []string      `json:"udpAddrs,omitempty"`
+		RelayNonce string        `json:"relayNonce,omitempty"`
+		Candidates []Candidate   `json:"candidates,omitempty"`
+		Nominate   bool          `json:"nominate,omitempty"`
+		NAT        *NATInfo      `json:"nat,omitempty"`
+		Proof      *ChannelProof `json:"proof,omitempty"`
+		Sealed     []byte        `json:"sealed,omitempty"`
+		CanUnseal  bool          `json:"canUnseal,omitempty"`
+		// Whether the streams are framed with heartbeats
+		Heartbeat bool `json:"heartbeat,omitempty"`
+		// CPace message when sharing with a code
+		PAKE []byte `json:"pake,omitempty"`
+
+		// Set by Authenticate
+		key     ed25519.PrivateKey // signs the proof
+		sealKey []byte             // seals the info, and opens the peer's
+		plain   bool               // sends the info in the clear
+		// Set by Share
+		pake *cpace
 	}
 	AddrPair struct {
 		PriAddr string `json:"priAddr"`
 		PubAddr string `json:"pubAddr"`
 	}
 	PeerInfo struct {
-		Laddr     string
-		PeerAddrs []AddrPair `json:"peerAddrs"`
-		Strategy  []string   `json:"strategy,omitempty"`
-		PeerNPlan int        `json:"peerNPlan,omitempty"`
-		TSAddr    string     `json:"tsAddr,omitempty"`
-		TSCap     uint       `json:"tsCap,omitempty"`
+		Laddr      string
+		PeerAddrs  []AddrPair    `json:"peerAddrs"`
+		Strategy   []string      `json:"strategy,omitempty"`
+		PeerNPlan  int           `json:"peerNPlan,omitempty"`
+		TSAddr     string        `json:"tsAddr,omitempty"`
+		TSCap      uint          `json:"tsCap,omitempty"`
+		UDPAddrs   []string      `json:"udpAddrs,omitempty"`
+		RelayNonce string        `json:"relayNonce,omitempty"`
+		Candidates []Candidate   `json:"candidates,omitempty"`
+		Nominate   bool          `json:"nominate,omitempty"`
+		NAT        *NATInfo      `json:"nat,omitempty"`
+		Proof      *ChannelProof `json:"proof,omitempty"`
+		Sealed     []byte        `json:"sealed,omitempty"`
+		CanUnseal  bool          `json:"canUnseal,omitempty"`
+		Heartbeat  bool          `json:"heartbeat,omitempty"`
+		PAKE       []byte        `json:"pake,omitempty"`
+		// Agreed on by sharing with a code, in place of the PSK
+		SessionKey []byte `json:"-"`
 	}
 )
 
@@ -66,6 +102,7 @@ func SetLogger(l Logger) {
 // ExchangeConnInfo exchanges oneself's info for the peer's info, which can be used to establish a connection
 func ExchangeConnInfo(ctx context.Context, bridgeURL string, info *SelfInfo, port int, useIPv6 bool) (*PeerInfo, error) {
 	client := NewHTTPClient(useIPv6, fmt.Sprintf(":%v", port))
+	defer client.Discard() // the port is reused for rendezvous, or for another exchange
 	sendReader, sendWriter := io.Pipe()
 	reqCtx, cancelReq := context.WithCancel(context.Background())
 	defer cancelReq()
@@ -80,6 +117,10 @@ func ExchangeConnInfo(ctx context.Context, bridgeURL string, info *SelfInfo, por
 		if err != nil {
 			err = fmt.Errorf("failed to open a connection to the bridge: %w", err)
 			chRecvOrErr <- readerOrError{nil, err}
+		} else if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+			_ = resp.Body.Close()
+			chRecvOrErr <- readerOrError{nil, fmt.Errorf("bridge responded with %s: %s", resp.Status, bytes.TrimSpace(msg))}
 		} else {
 			chRecvOrErr <- readerOrError{resp.Body, nil}
 		}
@@ -103,8 +144,13 @@ func ExchangeConnInfo(ctx context.Context, bridgeURL string, info *SelfInfo, por
 }
 
 func exchangeConnInfoProto(ctx context.Context, sender io.WriteCloser, chRecvOrErr <-chan readerOrError, sinfo *SelfInfo, cancelReq context.CancelFunc) (*PeerInfo, error) {
-	infoEnc, _ := json.Marshal(sinfo)
-	err := sendPacket(sender, infoEnc)
+	msg, err := sinfo.seal()
+	if err != nil {
+		return nil, err
+	}
+	msg.sign()
+	infoEnc, _ := json.Marshal(msg)
+	err = sendPacket(sender, infoEnc)
 	if err != nil {
 		return nil, fmt.Errorf("failed to communicate with the bridge: %w", err)
 	}
@@ -139,59 +185,201 @@ func exchangeConnInfoProto(ctx context.Context, sender io.WriteCloser, chRecvOrE
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse msg from bridge: %w", err)
 	}
-
-	pinfo.Laddr = sinfo.PriAddr
-	return &pinfo, nil
+	if err = pinfo.verifyPeer(sinfo); err != nil {
+		return nil, fmt.Errorf("failed to authenticate the peer: %w", err)
+	}
+	p, err := pinfo.unseal(sinfo)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.agree(sinfo); err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
-func flattenAddrs(aps []AddrPair) []string {
-	var addrs []string
-	for _, ap := range aps {
-		addrs = append(addrs, ap.PriAddr)
-		if ap.PubAddr != ap.PriAddr {
-			addrs = append(addrs, ap.PubAddr)
-		}
+// peerInfoOf turns the info sent by the peer into what the server would have replied,
+// where pubAddr is the address the peer is seen at
+func peerInfoOf(laddr string, p SelfInfo, pubAddr string) *PeerInfo {
+	return &PeerInfo{
+		Laddr:      laddr,
+		PeerAddrs:  []AddrPair{{PriAddr: p.PriAddr, PubAddr: pubAddr}},
+		Strategy:   p.Strategy,
+		PeerNPlan:  max(p.NPlan, 1),
+		TSAddr:     p.TSAddr,
+		TSCap:      p.TSCap,
+		UDPAddrs:   p.UDPAddrs,
+		RelayNonce: p.RelayNonce,
+		Candidates: p.Candidates,
+		Nominate:   p.Nominate,
+		NAT:        p.NAT,
+		Heartbeat:  p.Heartbeat,
+		PAKE:       p.PAKE,
 	}
-	return addrs
 }
 
 // RendezvousWithTimeout performs simultaneous connection opening for TCP hole punching, with `rendezvousTimeout`
 func RendezvousWithTimeout(ctx context.Context, laddr string, peerAddrs []AddrPair) (conn net.Conn, err error) {
-	ctx1, cancel := context.WithTimeout(ctx, rendezvousTimeout)
-	defer cancel()
-	conn, err = rendezvous(ctx1, laddr, flattenAddrs(peerAddrs))
-	if err != nil {
-		if errors.Is(ctx1.Err(), context.DeadlineExceeded) {
-			defaultLogger.Infof("rendezvous timeout for %v -> %v", laddr, peerAddrs)
-		}
-		return nil, err
-	}
-	return conn, nil
+	opts := RendezvousOptions{Timeout: rendezvousTimeout, AttemptTimeout: rendezvousTimeout}
+	return RendezvousCandidates(ctx, []string{laddr}, CandidatesOf(&PeerInfo{PeerAddrs: peerAddrs}, false), opts)
 }
 
-func rendezvous(ctx context.Context, laddr string, peerAddrs []string) (conn net.Conn, err error) {
-	defaultLogger.Infof("rendezvous with %s", strings.Join(peerAddrs, " | "))
-	chWin := make(chan net.Conn)
-	l, err := Listen(ctx, "tcp", laddr)
-	if err != nil {
-		return nil, fmt.Errorf("unable to set up rendezvous: %w", err)
+func rendezvous(ctx context.Context, laddrs []string, cands []Candidate, opts RendezvousOptions) (conn net.Conn, err error) {
+	var las []netip.AddrPort
+	for _, laddr := range laddrs {
+		la, err := netip.ParseAddrPort(laddr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to set up rendezvous: %w", err)
+		}
+		las = append(las, unmapAddrPort(la))
+	}
+	var addrs []string
+	for _, c := range cands {
+		addrs = append(addrs, c.Addr)
 	}
-	defer func() { _ = l.Close() }()
+	defaultLogger.Infof("rendezvous with %s", strings.Join(addrs, " | "))
+	chWin := make(chan net.Conn)
 	cc := make(chan struct{})
 	defer close(cc)
-	go accept(ctx, l, chWin, cc)
-	for _, peerAddr := range peerAddrs {
-		go connect(ctx, laddr, peerAddr, chWin, cc)
+
+	listenErrs := make(map[string]error) // by local address, nil for listening
+	listen := func(network, local string) error {
+		if err, done := listenErrs[local]; done {
+			return err
+		}
+		l, err := Listen(ctx, network, local)
+		if listenErrs[local] = err; err != nil {
+			return err
+		}
+		context.AfterFunc(ctx, func() { _ = l.Close() })
+		go accept(ctx, l, chWin, cc)
+		return nil
 	}
+	var errs []error
+	for _, la := range las {
+		if err = listen(localAddrFor(la, la)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == len(las) {
+		return nil, fmt.Errorf("unable to set up rendezvous: %w", errors.Join(errs...))
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range cands {
+		ra, err := netip.ParseAddrPort(c.Addr)
+		if err != nil {
+			defaultLogger.Debugf("skip candidate %s: %v", c.Addr, err)
+			continue
+		}
+		for _, la := range las {
+			network, local := localAddrFor(la, unmapAddrPort(ra))
+			if err = listen(network, local); err != nil {
+				defaultLogger.Debugf("skip candidate %s from %s: %v", c.Addr, local, err)
+				continue
+			}
+			wg.Go(func() { // happy eyeballs: give the preferred candidates a head start
+				select {
+				case <-time.After(time.Duration(i) * candidateStagger):
+				case <-ctx.Done():
+					return
+				}
+				ctx, cancel := context.WithTimeout(ctx, opts.AttemptTimeout)
+				defer cancel()
+				connect(ctx, local, c.Addr, chWin, cc)
+			})
+		}
+	}
+	allFailed := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(allFailed)
+	}()
 
+	if opts.Nomination == NominationControlled {
+		return followNomination(ctx, chWin, allFailed)
+	}
 	select {
 	case conn = <-chWin:
+	case <-allFailed:
+		return nil, errors.New("all rendezvous attempts failed")
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
+	if opts.Nomination == NominationControlling {
+		if err = nominate(ctx, conn); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
 	return conn, nil
 }
 
+// nominationMark is sent over the connection picked by the controlling side
+const nominationMark = 0x01
+
+func nominate(ctx context.Context, conn net.Conn) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetWriteDeadline(deadline)
+		defer func() { _ = conn.SetWriteDeadline(time.Time{}) }()
+	}
+	if _, err := conn.Write([]byte{nominationMark}); err != nil {
+		return fmt.Errorf("failed to nominate the connection: %w", err)
+	}
+	defaultLogger.Debugf("nominated %v->%v", conn.LocalAddr(), conn.RemoteAddr())
+	return nil
+}
+
+// followNomination waits on all connections established for the one nominated by the peer,
+// closing the others
+func followNomination(ctx context.Context, chWin <-chan net.Conn, allFailed <-chan struct{}) (net.Conn, error) {
+	chNominated, chRejected := make(chan net.Conn), make(chan net.Conn)
+	var pending []net.Conn
+	defer func() {
+		for _, c := range pending {
+			_ = c.Close() // also unblocks the reads
+		}
+	}()
+	attemptsOver := false
+	for {
+		select {
+		case conn := <-chWin:
+			pending = append(pending, conn)
+			go func() {
+				if deadline, ok := ctx.Deadline(); ok {
+					_ = conn.SetReadDeadline(deadline)
+				}
+				mark := make([]byte, 1)
+				ch := chRejected
+				if _, err := io.ReadFull(conn, mark); err == nil && mark[0] == nominationMark {
+					_ = conn.SetReadDeadline(time.Time{})
+					ch = chNominated
+				}
+				select {
+				case ch <- conn:
+				case <-ctx.Done():
+				}
+			}()
+			continue
+		case conn := <-chNominated:
+			pending = slices.DeleteFunc(pending, func(c net.Conn) bool { return c == conn })
+			defaultLogger.Debugf("nominated by peer %v->%v", conn.LocalAddr(), conn.RemoteAddr())
+			return conn, nil
+		case conn := <-chRejected:
+			pending = slices.DeleteFunc(pending, func(c net.Conn) bool { return c == conn })
+			_ = conn.Close()
+		case <-allFailed:
+			allFailed, attemptsOver = nil, true
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// Give up once our attempts are over and nothing awaits nomination, as the peer would
+		if attemptsOver && len(pending) == 0 {
+			return nil, errors.New("all rendezvous attempts failed")
+		}
+	}
+}
+
 func sendPacket(conn io.Writer, data []byte) (err error) {
 	if err = binary.Write(conn, binary.BigEndian, lenType(len(data))); err != nil {
 		return
@@ -215,17 +403,21 @@ func receivePacket(conn io.Reader) (data []byte, err error) {
 }
 
 func accept(ctx context.Context, l net.Listener, chWin chan<- net.Conn, cc <-chan struct{}) {
-	conn, err := l.Accept()
-	if err != nil {
-		return
-	}
-	select {
-	case chWin <- conn:
-		defaultLogger.Debugf("accepted %v", conn.LocalAddr())
-	case <-cc:
-		_ = conn.Close()
-	case <-ctx.Done():
-		_ = conn.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case chWin <- conn:
+			defaultLogger.Debugf("accepted %v", conn.LocalAddr())
+		case <-cc:
+			_ = conn.Close()
+			return
+		case <-ctx.Done():
+			_ = conn.Close()
+			return
+		}
 	}
 }
 
@@ -5,11 +5,30 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"sync"
+	"time"
 
 	"github.com/huin/goupnp/dcps/internetgateway2"
 	"golang.org/x/sync/errgroup"
 )
 
+const (
+	portMappingLifetime      = 60 * time.Second
+	portMappingDeleteTimeout = 3 * time.Second
+)
+
+// portMapper is a protocol for requesting port mapping from the router
+type portMapper interface {
+	// AddPortMapping maps an external port to the same port on this host,
+	// returning the external endpoint that the router actually assigned
+	AddPortMapping(ctx context.Context, protocol string, port uint16, lifetime time.Duration) (netip.AddrPort, error)
+	// DeletePortMapping removes the mapping added for the port
+	DeletePortMapping(ctx context.Context, protocol string, port uint16) error
+
+	String() string
+}
+
 type routerClient interface {
 	AddPortMappingCtx(
 		ctx context.Context,
@@ -23,34 +42,157 @@ type routerClient interface {
 		NewLeaseDuration uint32,
 	) error
 
+	DeletePortMappingCtx(
+		ctx context.Context,
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+	) error
+
 	LocalAddr() net.IP
 
 	GetExternalIPAddress() (string, error)
 }
 
-func AddPortMapping(ctx context.Context, ports ...int) error {
-	client, err := pickRouterClient(ctx)
+// upnpMapper speaks UPnP IGD through one of the router client types
+type upnpMapper struct {
+	client routerClient
+}
+
+func (m upnpMapper) String() string { return "UPnP" }
+
+func (m upnpMapper) AddPortMapping(ctx context.Context, protocol string, port uint16, lifetime time.Duration) (netip.AddrPort, error) {
+	err := m.client.AddPortMappingCtx(ctx, "", port, protocol, port, m.client.LocalAddr().String(), true, "acp", uint32(lifetime.Seconds()))
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	extIP, err := m.client.GetExternalIPAddress()
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("failed to get external IP: %w", err)
+	}
+	ip, err := netip.ParseAddr(extIP)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid external IP %q: %w", extIP, err)
+	}
+	return netip.AddrPortFrom(ip.Unmap(), port), nil
+}
+
+func (m upnpMapper) DeletePortMapping(ctx context.Context, protocol string, port uint16) error {
+	return m.client.DeletePortMappingCtx(ctx, "", port, protocol)
+}
+
+// PortMapping holds TCP port mappings on the router, renewing them until closed
+type PortMapping struct {
+	mapper portMapper
+	// The external endpoint assigned for each mapped local port
+	External map[int]netip.AddrPort
+
+	stop      context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// MapPorts requests TCP port mapping for the local ports from the router, via whichever of
+// UPnP, NAT-PMP and PCP it supports. It fails only if none of the ports can be mapped.
+func MapPorts(ctx context.Context, ports ...int) (*PortMapping, error) {
+	mapper, err := pickPortMapper(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to find a router client: %w", err)
+		return nil, fmt.Errorf("failed to find a router client: %w", err)
 	}
+	return newPortMapping(ctx, mapper, ports, portMappingLifetime/2)
+}
 
+func newPortMapping(ctx context.Context, mapper portMapper, ports []int, renewInterval time.Duration) (*PortMapping, error) {
+	m := &PortMapping{mapper: mapper, External: make(map[int]netip.AddrPort)}
 	var errs []error
 	for _, port := range ports {
-		err = client.AddPortMappingCtx(ctx, "", uint16(port), "TCP", uint16(port), client.LocalAddr().String(), true, "acp", 60)
+		ext, err := mapper.AddPortMapping(ctx, "TCP", uint16(port), portMappingLifetime)
 		if err != nil {
-			errs = append(errs, fmt.Errorf("failed to add port mapping: %w", err))
+			errs = append(errs, fmt.Errorf("failed to add port mapping via %v: %w", mapper, err))
+			continue
+		}
+		defaultLogger.Debugf("port mapping via %v: %v -> :%d", mapper, ext, port)
+		m.External[port] = ext
+	}
+	if len(m.External) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	if len(errs) > 0 {
+		defaultLogger.Debugf("%v", errors.Join(errs...))
+	}
+
+	var renewCtx context.Context
+	renewCtx, m.stop = context.WithCancel(context.Background())
+	m.done = make(chan struct{})
+	go m.renew(renewCtx, renewInterval)
+	return m, nil
+}
+
+// renew refreshes the mappings before the lease expires
+func (m *PortMapping) renew(ctx context.Context, interval time.Duration) {
+	defer close(m.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		for port, ext := range m.External {
+			got, err := m.mapper.AddPortMapping(ctx, "TCP", uint16(port), portMappingLifetime)
+			if err != nil {
+				defaultLogger.Debugf("failed to renew port mapping for :%d: %v", port, err)
+			} else if got != ext {
+				defaultLogger.Debugf("port mapping for :%d changed from %v to %v", port, ext, got)
+			}
 		}
 	}
+}
+
+// Close stops renewing and deletes the mappings from the router
+func (m *PortMapping) Close() (err error) {
+	m.closeOnce.Do(func() {
+		m.stop()
+		<-m.done
+		ctx, cancel := context.WithTimeout(context.Background(), portMappingDeleteTimeout)
+		defer cancel()
+		var errs []error
+		for port := range m.External {
+			if err := m.mapper.DeletePortMapping(ctx, "TCP", uint16(port)); err != nil {
+				errs = append(errs, fmt.Errorf("failed to delete port mapping for :%d: %w", port, err))
+			}
+		}
+		if err = errors.Join(errs...); err == nil {
+			defaultLogger.Debugf("port mapping deleted")
+		}
+	})
+	return
+}
 
-	return errors.Join(errs...)
+// DiscoverPortMapper looks for a port mapping service on the router, returning the name of its protocol
+func DiscoverPortMapper(ctx context.Context) (string, error) {
+	mapper, err := pickPortMapper(ctx)
+	if err != nil {
+		return "", err
+	}
+	return mapper.String(), nil
 }
 
-func pickRouterClient(ctx context.Context) (routerClient, error) {
+// pickPortMapper tries all the protocols in parallel and returns the first one available
+func pickPortMapper(ctx context.Context) (portMapper, error) {
 	tasks, _ := errgroup.WithContext(ctx)
-	chFound := make(chan routerClient)
+	chFound := make(chan portMapper)
 	tasks.Go(discoverWith(internetgateway2.NewWANIPConnection1ClientsCtx, ctx, chFound))
 	tasks.Go(discoverWith(internetgateway2.NewWANIPConnection2ClientsCtx, ctx, chFound))
 	tasks.Go(discoverWith(internetgateway2.NewWANPPPConnection1ClientsCtx, ctx, chFound))
+	if gw, err := DefaultGateway(); err == nil {
+		gateway := netip.AddrPortFrom(gw, natPMPPort)
+		tasks.Go(probeWith(&natPMPClient{gateway: gateway}, ctx, chFound))
+		tasks.Go(probeWith(&pcpClient{gateway: gateway}, ctx, chFound))
+	} else {
+		defaultLogger.Debugf("skip NAT-PMP and PCP: %v", err)
+	}
 
 	chErr := make(chan error)
 	go func() {
@@ -72,16 +214,29 @@ func pickRouterClient(ctx context.Context) (routerClient, error) {
 	return c, nil
 }
 
-func discoverWith[T routerClient](newc func(context.Context) ([]T, []error, error), ctx context.Context, chFound chan routerClient) func() error {
+func discoverWith[T routerClient](newc func(context.Context) ([]T, []error, error), ctx context.Context, chFound chan portMapper) func() error {
 	return func() (err error) {
 		cs, _, err := newc(ctx)
 		for _, c := range cs {
-			chFound <- c
+			chFound <- upnpMapper{c}
 		}
 		return
 	}
 }
 
+func probeWith[T interface {
+	portMapper
+	probe(context.Context) error
+}](m T, ctx context.Context, chFound chan portMapper) func() error {
+	return func() error {
+		if err := m.probe(ctx); err != nil {
+			return err
+		}
+		chFound <- m
+		return nil
+	}
+}
+
 func drain[T any](ch chan T) {
 	for range ch {
 	}
@@ -0,0 +1,61 @@
+package pnet
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockMapper struct {
+	mu      sync.Mutex
+	added   map[uint16]int // port -> times added
+	deleted map[uint16]bool
+}
+
+func (m *mockMapper) String() string { return "mock" }
+
+func (m *mockMapper) AddPortMapping(_ context.Context, _ string, port uint16, _ time.Duration) (netip.AddrPort, error) {
+	if port == 1 {
+		return netip.AddrPort{}, errors.New("port refused")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.added[port]++
+	return netip.AddrPortFrom(mockExtIP, port+1000), nil
+}
+
+func (m *mockMapper) DeletePortMapping(_ context.Context, _ string, port uint16) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted[port] = true
+	return nil
+}
+
+func TestPortMappingLifecycle(t *testing.T) {
+	defaultLogger = &testLogger{t}
+	mapper := &mockMapper{added: make(map[uint16]int), deleted: make(map[uint16]bool)}
+	m, err := newPortMapping(context.Background(), mapper, []int{1, 4000}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to map ports: %v", err)
+	}
+	if len(m.External) != 1 || m.External[4000] != netip.AddrPortFrom(mockExtIP, 5000) {
+		t.Fatalf("unexpected external endpoints: %v", m.External)
+	}
+	time.Sleep(180 * time.Millisecond)
+	if err = m.Close(); err != nil {
+		t.Fatalf("failed to close port mapping: %v", err)
+	}
+	_ = m.Close() // idempotent
+
+	mapper.mu.Lock()
+	defer mapper.mu.Unlock()
+	if mapper.added[4000] < 3 {
+		t.Errorf("expect the mapping to be renewed, added %d times", mapper.added[4000])
+	}
+	if !mapper.deleted[4000] || mapper.deleted[1] {
+		t.Errorf("expect only the mapped port to be deleted, got %v", mapper.deleted)
+	}
+}
@@ -0,0 +1,215 @@
+package pnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Port prediction for traversing symmetric NATs, which allocate a new public port for every
+// new connection, so that the port observed by the rendezvous server is useless to the peer.
+//
+// Each side samples a few new connections to infer how its NAT allocates ports. With a NAT
+// allocating sequentially, the next public ports can be predicted; with a random one, the
+// sides resort to a birthday-paradox spray: one side opens many mappings while the other
+// probes as many random ports, which collide with a fair chance.
+
+const (
+	NATNone       = "none"       // public address is on the host
+	NATPreserving = "preserving" // public port is the same as the local port
+	NATSequential = "sequential" // public ports are allocated in increasing order
+	NATRandom     = "random"
+	NATUnknown    = "unknown" // the sampling failed
+
+	natSamples         = 4
+	maxSequentialDelta = 64
+	sprayTimeout       = 4 * time.Second
+	minPredictedPort   = 1024
+)
+
+// NATInfo describes how the NAT allocates public ports for new TCP connections
+type NATInfo struct {
+	Pattern string `json:"pattern"`
+	// Increment of the public port between successive connections, for NATSequential
+	Delta int `json:"delta,omitempty"`
+}
+
+// Predictable tells whether the public port of a local port is known beforehand
+func (n *NATInfo) Predictable() bool {
+	return n.Pattern == NATNone || n.Pattern == NATPreserving
+}
+
+// SampleNAT observes the public endpoints of a few new connections to the rendezvous server,
+// to infer how the NAT (if any) allocates public ports
+func SampleNAT(ctx context.Context, whoamiURL string, useIPv6 bool) (*NATInfo, error) {
+	var locals, pubs []netip.AddrPort
+	for range natSamples {
+		// A new client makes a new connection from a new port
+		local, pub, err := whoami(ctx, whoamiURL, useIPv6, ":0")
+		if err != nil {
+			return nil, fmt.Errorf("failed to sample NAT behaviour: %w", err)
+		}
+		locals, pubs = append(locals, local), append(pubs, pub)
+	}
+	info := classifyNAT(locals, pubs)
+	defaultLogger.Debugf("NAT behaviour: %+v, sampled %v -> %v", *info, locals, pubs)
+	return info, nil
+}
+
+// whoami asks the server for the public endpoint of a new connection from laddr
+func whoami(ctx context.Context, whoamiURL string, useIPv6 bool, laddr string) (local, pub netip.AddrPort, err error) {
+	client := NewHTTPClient(useIPv6, laddr)
+	defer client.Discard()
+	req, err := http.NewRequestWithContext(ctx, "GET", whoamiURL, nil)
+	if err != nil {
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("server responded with %s", resp.Status)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return
+	}
+	if pub, err = netip.ParseAddrPort(strings.TrimSpace(string(body))); err != nil {
+		err = fmt.Errorf("unexpected reply from server: %w", err)
+		return
+	}
+	la := (<-client.GetLAddr()).(*net.TCPAddr).AddrPort()
+	return unmapAddrPort(la), unmapAddrPort(pub), nil
+}
+
+func classifyNAT(locals, pubs []netip.AddrPort) *NATInfo {
+	noNAT, preserving := true, true
+	for i := range pubs {
+		noNAT = noNAT && pubs[i] == locals[i]
+		preserving = preserving && pubs[i].Port() == locals[i].Port()
+	}
+	switch {
+	case noNAT:
+		return &NATInfo{Pattern: NATNone}
+	case preserving:
+		return &NATInfo{Pattern: NATPreserving}
+	}
+	delta := maxSequentialDelta + 1
+	for i := 1; i < len(pubs); i++ {
+		// Other traffic on the host may take ports in between, so the smallest step is the increment
+		d := int(pubs[i].Port()) - int(pubs[i-1].Port())
+		if d <= 0 || d > maxSequentialDelta {
+			return &NATInfo{Pattern: NATRandom}
+		}
+		delta = min(delta, d)
+	}
+	return &NATInfo{Pattern: NATSequential, Delta: delta}
+}
+
+// PredictPorts guesses n public ports that the NAT is going to allocate for new connections,
+// following the last observed public port
+func PredictPorts(info *NATInfo, lastPort int, n int) []int {
+	ports := make([]int, n)
+	for i := range ports {
+		switch info.Pattern {
+		case NATSequential:
+			ports[i] = lastPort + info.Delta*(i+1)
+			if ports[i] > 65535 {
+				ports[i] = minPredictedPort + (ports[i]-minPredictedPort)%(65536-minPredictedPort)
+			}
+		case NATRandom:
+			ports[i] = minPredictedPort + rand.IntN(65536-minPredictedPort)
+		default:
+			ports[i] = lastPort
+		}
+	}
+	return ports
+}
+
+// Spray performs many simultaneous connection openings at once, returning the first that succeeds.
+// If laddr is given, all attempts are made from it towards each of the targets; otherwise each of
+// the n attempts opens a new local port towards targets[i % len(targets)].
+// As several might succeed, one side nominates the connection to keep, as in RendezvousOptions.
+func Spray(ctx context.Context, useIPv6 bool, laddr string, n int, targets []string, nomination int) (net.Conn, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("no target to spray")
+	}
+	defaultLogger.Infof("spraying %d connections towards %d port(s) of %s", n, len(slices.Compact(slices.Sorted(slices.Values(targets)))), hostOf(targets[0]))
+	ctx, cancel := context.WithTimeout(ctx, sprayTimeout)
+	defer cancel()
+	chWin := make(chan net.Conn)
+	cc := make(chan struct{})
+	defer close(cc)
+
+	network := tern(useIPv6, "tcp6", "tcp4")
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+	}()
+	if laddr != "" {
+		l, err := Listen(ctx, network, laddr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to set up spray: %w", err)
+		}
+		listeners = append(listeners, l)
+		go accept(ctx, l, chWin, cc)
+		for _, t := range targets[:min(n, len(targets))] {
+			go connect(ctx, laddr, t, chWin, cc)
+		}
+	} else {
+		for i := range n {
+			l, err := Listen(ctx, network, ":0")
+			if err != nil { // e.g. running out of file descriptors
+				defaultLogger.Debugf("spray stopped at %d sockets: %v", i, err)
+				break
+			}
+			listeners = append(listeners, l)
+			go accept(ctx, l, chWin, cc)
+			go connect(ctx, l.Addr().String(), targets[i%len(targets)], chWin, cc)
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if nomination == NominationControlled {
+		// The peer might still get through to our listeners after our attempts are over
+		conn, err = followNomination(ctx, chWin, nil)
+	} else {
+		select {
+		case conn = <-chWin:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			defaultLogger.Infof("spray timeout")
+		}
+		return nil, err
+	}
+	if nomination == NominationControlling {
+		if err = nominate(ctx, conn); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func hostOf(addr string) string {
+	host, _, _ := net.SplitHostPort(addr)
+	return host
+}
@@ -0,0 +1,111 @@
+package pnet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestClassifyNAT(t *testing.T) {
+	ap := netip.MustParseAddrPort
+	locals := []netip.AddrPort{ap("192.168.1.2:40000"), ap("192.168.1.2:40007"), ap("192.168.1.2:40020"), ap("192.168.1.2:40021")}
+	for _, tc := range []struct {
+		pubs   []string
+		expect NATInfo
+	}{
+		{[]string{"192.168.1.2:40000", "192.168.1.2:40007", "192.168.1.2:40020", "192.168.1.2:40021"}, NATInfo{Pattern: NATNone}},
+		{[]string{"1.2.3.4:40000", "1.2.3.4:40007", "1.2.3.4:40020", "1.2.3.4:40021"}, NATInfo{Pattern: NATPreserving}},
+		{[]string{"1.2.3.4:3000", "1.2.3.4:3002", "1.2.3.4:3006", "1.2.3.4:3008"}, NATInfo{Pattern: NATSequential, Delta: 2}},
+		{[]string{"1.2.3.4:3000", "1.2.3.4:51234", "1.2.3.4:8000", "1.2.3.4:23456"}, NATInfo{Pattern: NATRandom}},
+	} {
+		var pubs []netip.AddrPort
+		for _, p := range tc.pubs {
+			pubs = append(pubs, ap(p))
+		}
+		if got := classifyNAT(locals, pubs); *got != tc.expect {
+			t.Errorf("classify %v: expect: %+v, got: %+v", tc.pubs, tc.expect, *got)
+		}
+	}
+}
+
+func TestPredictPorts(t *testing.T) {
+	got := PredictPorts(&NATInfo{Pattern: NATSequential, Delta: 2}, 65532, 3)
+	if expect := []int{65534, minPredictedPort, minPredictedPort + 2}; fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Errorf("expect: %v, got: %v", expect, got)
+	}
+	for _, p := range PredictPorts(&NATInfo{Pattern: NATRandom}, 3000, 100) {
+		if p < minPredictedPort || p > 65535 {
+			t.Fatalf("predicted port out of range: %d", p)
+		}
+	}
+}
+
+func TestSpray(t *testing.T) {
+	defaultLogger = &testLogger{t}
+	port, err := FreePort(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	// The predictable side aims at a few ports of the other side, which are all wrong,
+	// while the other side aims all its new mappings at the predictable side
+	chConn := make(chan error, 1)
+	go func() {
+		conn, err := Spray(context.Background(), false, laddr, 4, []string{"127.0.0.1:1", "127.0.0.1:2"}, NominationNone)
+		if err == nil {
+			_ = conn.Close()
+		}
+		chConn <- err
+	}()
+	conn, err := Spray(context.Background(), false, "", 8, []string{laddr}, NominationNone)
+	if err != nil {
+		t.Fatalf("spray failed: %v", err)
+	}
+	_ = conn.Close()
+	if err = <-chConn; err != nil {
+		t.Fatalf("spray from the predictable side failed: %v", err)
+	}
+}
+
+func TestSprayNomination(t *testing.T) {
+	defaultLogger = &testLogger{t}
+	port, err := FreePort(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	// All the new mappings get through to the predictable side, which must keep the one nominated
+	chConn := make(chan net.Conn, 1)
+	go func() {
+		conn, err := Spray(context.Background(), false, laddr, 1, []string{"127.0.0.1:1"}, NominationControlled)
+		if err != nil {
+			t.Errorf("spray from the predictable side failed: %v", err)
+		}
+		chConn <- conn
+	}()
+	conn, err := Spray(context.Background(), false, "", 8, []string{laddr}, NominationControlling)
+	if err != nil {
+		t.Fatalf("spray failed: %v", err)
+	}
+	defer conn.Close()
+	peer := <-chConn
+	if peer == nil {
+		t.FailNow()
+	}
+	defer peer.Close()
+	if conn.LocalAddr().String() != peer.RemoteAddr().String() {
+		t.Fatalf("sides kept different connections: %v, %v", conn.LocalAddr(), peer.RemoteAddr())
+	}
+	if _, err = conn.Write([]byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err = io.ReadFull(peer, b); err != nil || string(b) != "ok" {
+		t.Fatalf("unexpected read over the nominated connection: %q, %v", b, err)
+	}
+}
@@ -0,0 +1,178 @@
+package pnet
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// Connections to the rendezvous server and the relay can go through a SOCKS5 or HTTP CONNECT proxy,
+// for networks where outbound traffic is only allowed that way. The traffic is always tunneled,
+// so that the exchange streams both ways as it does on a direct connection.
+
+var defaultPorts = map[string]string{"http": "80", "https": "443", "socks5": "1080", "socks5h": "1080"}
+
+var defaultProxy *url.URL
+
+// SetProxy routes connections made by DialUpstream (and thus HTTPClient) through the proxy.
+// A nil proxy means direct connections.
+func SetProxy(u *url.URL) {
+	defaultProxy = u
+}
+
+// Proxied tells whether connections go through a proxy, where hole punching is impossible
+func Proxied() bool {
+	return defaultProxy != nil
+}
+
+// ProxyFor resolves the proxy for reaching target (a URL). The proxy is either configured explicitly,
+// where "direct" disables the proxy, or taken from the environment variables HTTPS_PROXY, HTTP_PROXY,
+// ALL_PROXY and NO_PROXY (or their lowercase versions). It returns nil if no proxy should be used.
+func ProxyFor(configured string, target string) (*url.URL, error) {
+	switch configured {
+	case "direct":
+		return nil, nil
+	case "":
+	default:
+		return parseProxy(configured)
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %s: %w", target, err)
+	}
+	env := httpproxy.FromEnvironment()
+	if all := getEnvAny("ALL_PROXY", "all_proxy"); all != "" {
+		env.HTTPProxy = cmp.Or(env.HTTPProxy, all)
+		env.HTTPSProxy = cmp.Or(env.HTTPSProxy, all)
+	}
+	p, err := env.ProxyFunc()(u)
+	if err != nil || p == nil {
+		return nil, err
+	}
+	return parseProxy(p.String())
+}
+
+func parseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %w", s, err)
+	}
+	if _, ok := defaultPorts[u.Scheme]; !ok || u.Host == "" {
+		return nil, fmt.Errorf("unsupported proxy %s: expect socks5://, http:// or https:// with a host", u.Redacted())
+	}
+	return u, nil
+}
+
+// DialUpstream connects to addr through the proxy, if any
+func DialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	if defaultProxy == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	conn, err := dialProxy(ctx, defaultProxy, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s via proxy %s: %w", addr, defaultProxy.Redacted(), err)
+	}
+	return conn, nil
+}
+
+func dialProxy(ctx context.Context, u *url.URL, addr string) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), defaultPorts[u.Scheme])
+	}
+	if u.Scheme == "socks5" || u.Scheme == "socks5h" {
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		d, err := proxy.SOCKS5("tcp", host, auth, &net.Dialer{})
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	if u.Scheme == "https" {
+		tconn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err = tconn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tconn
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err = req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	// Not closing the body, which is the tunnel for a successful CONNECT
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy refused: %s", resp.Status)
+	}
+	if !stop() { // ctx is done and conn is closed
+		return nil, ctx.Err()
+	}
+	if br.Buffered() > 0 { // the target spoke first
+		return &prefixedConn{Conn: conn, r: io.MultiReader(io.LimitReader(br, int64(br.Buffered())), conn)}, nil
+	}
+	return conn, nil
+}
+
+// prefixedConn is a net.Conn whose reads start with the data already buffered
+type prefixedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func getEnvAny(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
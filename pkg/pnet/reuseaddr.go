@@ -6,9 +6,19 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"time"
 )
 
-var listenConfig = net.ListenConfig{Control: control}
+// TCP keepalive tuned for detecting a dead peer within a minute,
+// rather than the OS default of hours
+var keepAliveConfig = net.KeepAliveConfig{
+	Enable:   true,
+	Idle:     15 * time.Second,
+	Interval: 5 * time.Second,
+	Count:    4,
+}
+
+var listenConfig = net.ListenConfig{Control: control, KeepAliveConfig: keepAliveConfig}
 
 func Listen(ctx context.Context, network, address string) (net.Listener, error) {
 	return listenConfig.Listen(ctx, network, address)
@@ -24,8 +34,9 @@ func DialContext(ctx context.Context, network, laddr, raddr string) (net.Conn, e
 		return nil, fmt.Errorf("dial failed to resolve laddr %v: %w", laddr, err)
 	}
 	d := net.Dialer{
-		Control:   control,
-		LocalAddr: nla,
+		Control:         control,
+		LocalAddr:       nla,
+		KeepAliveConfig: keepAliveConfig,
 	}
 	return d.DialContext(ctx, network, raddr)
 }
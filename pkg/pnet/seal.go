@@ -0,0 +1,80 @@
+package pnet
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Sealing keeps the connection info private from the rendezvous server.
+//
+// The info is encrypted under a key derived from the PSK, and sent in an envelope with nothing
+// but what the server needs: the channel name, its proof, and an empty private address. The server
+// fills in the public address it observes as usual, which is the only part of the reply in the clear.
+//
+// Every version that seals reads both forms. A peer sending its info in the clear without
+// CanUnseal is taken as a legacy one, which cannot read ours; the exchange then fails with advice
+// instead of leaving both sides with nothing to connect to.
+
+// seal returns the envelope to be sent in place of the info, or the info itself if sent in the clear
+func (info *SelfInfo) seal() (*SelfInfo, error) {
+	if info.sealKey == nil || info.plain {
+		return info, nil
+	}
+	payload := *info
+	payload.ChanName, payload.Proof = "", nil
+	plaintext, err := json.Marshal(&payload)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(info.sealKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, _ = rand.Read(nonce)
+	return &SelfInfo{
+		ChanName: info.ChanName,
+		Sealed:   aead.Seal(nonce, nonce, plaintext, []byte(info.ChanName)),
+		key:      info.key,
+	}, nil
+}
+
+// unseal opens the peer's info if sealed. self is what we have sent.
+func (info *PeerInfo) unseal(self *SelfInfo) (*PeerInfo, error) {
+	if info.Sealed == nil {
+		if self.sealKey != nil && !self.plain && !info.CanUnseal {
+			return nil, errors.New("the peer runs an older version of acp that cannot read sealed info; " +
+				"upgrade it, or set plainInfo to true on this device")
+		}
+		info.Laddr = self.PriAddr
+		return info, nil
+	}
+	if self.sealKey == nil {
+		return nil, errors.New("peer sent sealed info over an unauthenticated channel")
+	}
+	aead, err := chacha20poly1305.NewX(self.sealKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.Sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed sealed info from peer")
+	}
+	nonce, ciphertext := info.Sealed[:aead.NonceSize()], info.Sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(self.ChanName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sealed info from peer: %w", err)
+	}
+	var p SelfInfo
+	if err = json.Unmarshal(plaintext, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse sealed info from peer: %w", err)
+	}
+	var pubAddr string
+	if len(info.PeerAddrs) > 0 {
+		pubAddr = info.PeerAddrs[0].PubAddr
+	}
+	return peerInfoOf(self.PriAddr, p, pubAddr), nil
+}
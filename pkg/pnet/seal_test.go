@@ -0,0 +1,85 @@
+package pnet
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// relayed sends the info out as ExchangeConnInfo does, and turns it into the reply of the server
+func relayed(t *testing.T, s *SelfInfo) *PeerInfo {
+	msg, err := s.seal()
+	if err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+	msg.sign()
+	b, _ := json.Marshal(msg)
+	var m map[string]any
+	_ = json.Unmarshal(b, &m)
+	m["peerAddrs"] = []AddrPair{{PriAddr: m["priAddr"].(string), PubAddr: "203.0.113.1:9000"}}
+	delete(m, "priAddr")
+	delete(m, "chanName")
+	b, _ = json.Marshal(m)
+	var p PeerInfo
+	_ = json.Unmarshal(b, &p)
+	return &p
+}
+
+func TestSealInfo(t *testing.T) {
+	newInfo := func(plain bool) *SelfInfo {
+		var s SelfInfo
+		s.Authenticate("AAAAAAAA", []byte("psk"), plain)
+		s.PriAddr = "192.168.1.2:9000"
+		s.Strategy = []string{"tcp_punch", "relay"}
+		s.RelayNonce = "secret-nonce"
+		s.Nominate = true
+		return &s
+	}
+
+	sealed := relayed(t, newInfo(false))
+	b, _ := json.Marshal(sealed)
+	for _, leak := range []string{"192.168.1.2", "tcp_punch", "secret-nonce"} {
+		if bytes.Contains(b, []byte(leak)) {
+			t.Errorf("server sees %q in %s", leak, b)
+		}
+	}
+	for _, plain := range []bool{false, true} { // a peer sending in the clear reads sealed info as well
+		self := newInfo(plain)
+		self.PriAddr = "192.168.1.3:9000"
+		if err := sealed.verifyPeer(self); err != nil {
+			t.Fatalf("sealed info rejected: %v", err)
+		}
+		p, err := sealed.unseal(self)
+		if err != nil {
+			t.Fatalf("failed to unseal: %v", err)
+		}
+		if p.Laddr != self.PriAddr || p.PeerAddrs[0] != (AddrPair{"192.168.1.2:9000", "203.0.113.1:9000"}) ||
+			p.RelayNonce != "secret-nonce" || len(p.Strategy) != 2 || !p.Nominate || p.PeerNPlan != 1 {
+			t.Errorf("unexpected unsealed info: %+v", *p)
+		}
+	}
+
+	// Tampering with the sealed info is caught by both the proof and the seal
+	tampered := relayed(t, newInfo(false))
+	tampered.Sealed[len(tampered.Sealed)-1] ^= 1
+	if err := tampered.verifyPeer(newInfo(false)); err == nil {
+		t.Errorf("tampered proof accepted")
+	}
+	if _, err := tampered.unseal(newInfo(false)); err == nil {
+		t.Errorf("tampered seal opened")
+	}
+
+	// A peer sending in the clear on purpose, versus a legacy one
+	if _, err := relayed(t, newInfo(true)).unseal(newInfo(false)); err != nil {
+		t.Errorf("plain info rejected: %v", err)
+	}
+	legacy := relayed(t, newInfo(true))
+	legacy.CanUnseal = false
+	if _, err := legacy.unseal(newInfo(false)); err == nil || !strings.Contains(err.Error(), "plainInfo") {
+		t.Errorf("legacy peer not detected: %v", err)
+	}
+	if _, err := legacy.unseal(newInfo(true)); err != nil {
+		t.Errorf("legacy peer rejected in the clear: %v", err)
+	}
+}
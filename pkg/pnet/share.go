@@ -0,0 +1,149 @@
+package pnet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/gtank/ristretto255"
+)
+
+// Sharing lets someone outside the group receive files with a short one-time code, e.g. 7-tiger-anchor.
+//
+// The number, up to 6 digits, names the rendezvous channel, so that a channel is hardly taken by another
+// pair sharing at the same time, nor squatted by someone guessing it. The two words, out of 256 each,
+// are the password of a CPace exchange (https://datatracker.ietf.org/doc/draft-irtf-cfrg-cpace/)
+// on ristretto255, whose messages ride
+// along with the info. Each end comes out with the same session key only if they used the same code,
+// and anyone else, the server included, gets one guess per exchange at most. The session key then
+// stands in for the PSK, which is never involved, and the info is sent in the clear as nothing
+// derived from the code can seal it without opening it to guesses offline.
+
+const (
+	sharePrefix     = "s."
+	shareMaxNumber  = 999999
+	cpaceDSI        = "CPaceRistretto255"
+	cpaceCI         = "acp share"
+	cpaceSInBytes   = 128 // the input block size of SHA-512
+	cpaceScalarSize = 64  // reduced from uniform bytes
+)
+
+// NewShareCode generates a code of a number and two words
+func NewShareCode() string {
+	n, _ := rand.Int(rand.Reader, big.NewInt(shareMaxNumber))
+	var w [2]byte
+	_, _ = rand.Read(w[:])
+	return fmt.Sprintf("%d-%s-%s", n.Int64()+1, shareWords[w[0]], shareWords[w[1]])
+}
+
+// Share keys the info by a one-time code instead of the PSK, for a peer outside the group
+func (info *SelfInfo) Share(code string) error {
+	code = strings.ToLower(strings.TrimSpace(code))
+	number, password, ok := strings.Cut(code, "-")
+	if !ok || number == "" || password == "" || strings.Trim(number, "0123456789") != "" {
+		return fmt.Errorf("invalid code %q, expect something like 7-tiger-anchor", code)
+	}
+	info.ChanName = sharePrefix + number
+	info.key, info.sealKey = nil, nil
+	info.pake = newCPace([]byte(password), []byte(info.ChanName))
+	info.PAKE = info.pake.msg
+	return nil
+}
+
+// agree derives the session key from the CPace message of the peer
+func (info *PeerInfo) agree(self *SelfInfo) error {
+	if self.pake == nil {
+		return nil
+	}
+	if info.PAKE == nil {
+		return errors.New("the peer is not sharing with a code; make sure both sides use the same code")
+	}
+	key, err := self.pake.finish(info.PAKE)
+	if err != nil {
+		return fmt.Errorf("failed to agree on a session key: %w", err)
+	}
+	info.SessionKey = key
+	return nil
+}
+
+type cpace struct {
+	sid []byte
+	y   *ristretto255.Scalar
+	msg []byte
+}
+
+func newCPace(prs, sid []byte) *cpace {
+	h := sha512.Sum512(lvCat([]byte(cpaceDSI), prs, make([]byte, cpaceZPad(prs)), []byte(cpaceCI), sid))
+	g := ristretto255.NewElement().FromUniformBytes(h[:])
+	b := make([]byte, cpaceScalarSize)
+	_, _ = rand.Read(b)
+	y := ristretto255.NewScalar().FromUniformBytes(b)
+	return &cpace{sid: sid, y: y, msg: ristretto255.NewElement().ScalarMult(y, g).Encode(nil)}
+}
+
+// cpaceZPad pads the generator string, so that the password fills its first block
+func cpaceZPad(prs []byte) int {
+	return max(0, cpaceSInBytes-1-len(lvCat(prs))-len(lvCat([]byte(cpaceDSI))))
+}
+
+// finish returns the intermediate session key, with the messages ordered as both ends send at once
+func (c *cpace) finish(peerMsg []byte) ([]byte, error) {
+	peer := ristretto255.NewElement()
+	if err := peer.Decode(peerMsg); err != nil {
+		return nil, err
+	}
+	k := ristretto255.NewElement().ScalarMult(c.y, peer)
+	if k.Equal(ristretto255.NewElement().Zero()) == 1 {
+		return nil, errors.New("invalid CPace message from peer")
+	}
+	t1, t2 := lvCat(c.msg, nil), lvCat(peerMsg, nil)
+	if bytes.Compare(t1, t2) < 0 {
+		t1, t2 = t2, t1
+	}
+	isk := sha512.Sum512(bytes.Join([][]byte{lvCat([]byte(cpaceDSI+"_ISK"), c.sid, k.Encode(nil)), []byte("oc"), t1, t2}, nil))
+	return isk[:32], nil
+}
+
+// lvCat concatenates the parts, each prepended with its length in LEB128
+func lvCat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = binary.AppendUvarint(b, uint64(len(p)))
+		b = append(b, p...)
+	}
+	return b
+}
+
+var shareWords = [256]string{
+	"acid", "acorn", "actor", "adobe", "agent", "alarm", "album", "alley", "amber", "anchor", "angle",
+	"ankle", "apple", "apron", "arrow", "aspen", "atlas", "attic", "autumn", "bacon", "badge",
+	"bagel", "baker", "bamboo", "banjo", "barrel", "basil", "beacon", "beaver", "bench", "berry",
+	"bison", "blanket", "blossom", "bobcat", "bonus", "border", "bottle", "bracket", "bramble",
+	"bread", "breeze", "brick", "bridge", "bronze", "bucket", "buffalo", "bugle", "butter", "cabin",
+	"cactus", "camel", "candle", "canoe", "canyon", "carbon", "carpet", "cashew", "castle", "cedar",
+	"cello", "chalk", "cherry", "chess", "chimney", "cider", "circus", "citrus", "cliff", "clover",
+	"cobalt", "cocoa", "comet", "copper", "coral", "cotton", "cougar", "coyote", "crane", "crayon",
+	"cricket", "crystal", "cupcake", "dahlia", "daisy", "delta", "denim", "desert", "diamond",
+	"dolphin", "domino", "donkey", "dragon", "drum", "eagle", "easel", "echo", "eclipse", "elbow",
+	"ember", "emerald", "engine", "falcon", "feather", "fennel", "ferry", "fiddle", "flannel",
+	"flute", "forest", "fossil", "fountain", "fox", "galaxy", "garden", "garlic", "gazelle", "geyser",
+	"ginger", "glacier", "globe", "goblet", "granite", "grape", "gravel", "guitar", "hammock",
+	"harbor", "harvest", "hazel", "helmet", "heron", "hickory", "honey", "horizon", "husky", "igloo",
+	"indigo", "iris", "island", "ivory", "jacket", "jaguar", "jasmine", "jelly", "jigsaw", "jungle",
+	"juniper", "kayak", "kettle", "kiwi", "koala", "ladder", "lagoon", "lantern", "laurel", "lemon",
+	"lentil", "lily", "lizard", "lobster", "locket", "lotus", "magnet", "mango", "maple", "marble",
+	"meadow", "melon", "meteor", "mint", "mirror", "mitten", "monsoon", "mosaic", "mustard", "nectar",
+	"needle", "nickel", "noodle", "nutmeg", "oasis", "ocean", "olive", "onion", "orbit", "orchid",
+	"otter", "oyster", "paddle", "panda", "papaya", "parrot", "peach", "peanut", "pebble", "pepper",
+	"piano", "pickle", "pigeon", "pillow", "pine", "pixel", "planet", "plum", "pocket", "polar",
+	"pony", "poppy", "prairie", "pretzel", "puffin", "pumpkin", "quartz", "quill", "rabbit", "radish",
+	"raven", "ribbon", "river", "robin", "rocket", "saddle", "saffron", "salmon", "sandal", "satin",
+	"scarf", "shadow", "sherbet", "silver", "sketch", "sparrow", "spruce", "squid", "summit",
+	"sunset", "swan", "tango", "teapot", "thistle", "thunder", "tiger", "timber", "toffee", "tomato",
+	"topaz", "tulip", "tundra", "turtle", "velvet", "violet", "walnut", "walrus", "willow", "zebra",
+}
@@ -0,0 +1,53 @@
+package pnet
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestShare(t *testing.T) {
+	code := NewShareCode()
+	if parts := strings.Split(code, "-"); len(parts) != 3 {
+		t.Fatalf("unexpected code %q", code)
+	}
+	agreed := func(codeA, codeB string) (a, b []byte) {
+		var sa, sb SelfInfo
+		if err := sa.Share(codeA); err != nil {
+			t.Fatal(err)
+		}
+		if err := sb.Share(codeB); err != nil {
+			t.Fatal(err)
+		}
+		pa, pb := relayed(t, &sb), relayed(t, &sa)
+		for _, c := range []struct {
+			p    *PeerInfo
+			self *SelfInfo
+		}{{pa, &sa}, {pb, &sb}} {
+			if err := c.p.verifyPeer(c.self); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.p.agree(c.self); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return pa.SessionKey, pb.SessionKey
+	}
+
+	a, b := agreed(code, " "+strings.ToUpper(code))
+	if len(a) != 32 || !bytes.Equal(a, b) {
+		t.Errorf("session keys differ with the same code")
+	}
+	if a2, _ := agreed(code, code); bytes.Equal(a, a2) {
+		t.Errorf("session key reused")
+	}
+	if a, b = agreed("7-tiger-anchor", "7-tiger-acorn"); bytes.Equal(a, b) {
+		t.Errorf("same session key with different codes")
+	}
+
+	for _, invalid := range []string{"tiger-anchor", "7", "7-", "x7-tiger"} {
+		if err := new(SelfInfo).Share(invalid); err == nil {
+			t.Errorf("invalid code %q accepted", invalid)
+		}
+	}
+}
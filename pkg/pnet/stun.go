@@ -0,0 +1,160 @@
+package pnet
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// A minimal STUN client (RFC 5389), only for discovering the public endpoint
+// of a UDP socket through a Binding request
+
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112a442
+	stunHeaderLen       = 20
+
+	stunAttrMappedAddr    = 0x0001
+	stunAttrXorMappedAddr = 0x0020
+
+	stunAttemptInterval = 300 * time.Millisecond
+	stunTimeout         = 2 * time.Second
+)
+
+var errSTUNMalformed = errors.New("malformed STUN response")
+
+// STUNMappedAddr queries the STUN server for the public address of the packet conn.
+// It should be called before anything else starts reading from pconn.
+func STUNMappedAddr(ctx context.Context, pconn net.PacketConn, server string, useIPv6 bool) (netip.AddrPort, error) {
+	raddr, err := net.ResolveUDPAddr(tern(useIPv6, "udp6", "udp4"), server)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("failed to resolve STUN server %s: %w", server, err)
+	}
+	req := make([]byte, stunHeaderLen)
+	binary.BigEndian.PutUint16(req[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	txID := req[8:stunHeaderLen]
+	_, _ = rand.Read(txID)
+
+	ctx, cancel := context.WithTimeout(ctx, stunTimeout)
+	defer cancel()
+	go func() {
+		for {
+			_, _ = pconn.WriteTo(req, raddr)
+			select {
+			case <-time.After(stunAttemptInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	deadline, _ := ctx.Deadline()
+	_ = pconn.SetReadDeadline(deadline)
+	defer func() { _ = pconn.SetReadDeadline(time.Time{}) }()
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := pconn.ReadFrom(buf)
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("no response from STUN server %s: %w", server, err)
+		}
+		if from.String() != raddr.String() {
+			continue
+		}
+		ap, err := parseSTUNResponse(buf[:n], txID)
+		if errors.Is(err, errSTUNMalformed) {
+			continue
+		}
+		return ap, err
+	}
+}
+
+func parseSTUNResponse(b []byte, txID []byte) (netip.AddrPort, error) {
+	if len(b) < stunHeaderLen ||
+		binary.BigEndian.Uint16(b[0:]) != stunBindingResponse ||
+		binary.BigEndian.Uint32(b[4:]) != stunMagicCookie ||
+		string(b[8:stunHeaderLen]) != string(txID) {
+		return netip.AddrPort{}, errSTUNMalformed
+	}
+	attrs := b[stunHeaderLen:]
+	if l := int(binary.BigEndian.Uint16(b[2:])); l <= len(attrs) {
+		attrs = attrs[:l]
+	}
+	var mapped netip.AddrPort
+	for len(attrs) >= 4 {
+		typ, l := binary.BigEndian.Uint16(attrs[0:]), int(binary.BigEndian.Uint16(attrs[2:]))
+		if len(attrs) < 4+l {
+			break
+		}
+		val := attrs[4 : 4+l]
+		switch typ {
+		case stunAttrXorMappedAddr:
+			if ap, ok := parseSTUNAddr(val, b[4:stunHeaderLen]); ok {
+				return ap, nil
+			}
+		case stunAttrMappedAddr:
+			if ap, ok := parseSTUNAddr(val, nil); ok {
+				mapped = ap
+			}
+		}
+		attrs = attrs[4+(l+3)&^3:] // attributes are padded to 4 bytes
+	}
+	if mapped.IsValid() {
+		return mapped, nil
+	}
+	return netip.AddrPort{}, errors.New("STUN response carries no mapped address")
+}
+
+// parseSTUNAddr decodes a (XOR-)MAPPED-ADDRESS value; xor is the magic cookie
+// followed by the transaction ID, or nil for the non-XOR variant
+func parseSTUNAddr(v []byte, xor []byte) (netip.AddrPort, bool) {
+	if len(v) < 4 {
+		return netip.AddrPort{}, false
+	}
+	var ipLen int
+	switch v[1] {
+	case 0x01:
+		ipLen = 4
+	case 0x02:
+		ipLen = 16
+	default:
+		return netip.AddrPort{}, false
+	}
+	if len(v) < 4+ipLen {
+		return netip.AddrPort{}, false
+	}
+	port := binary.BigEndian.Uint16(v[2:])
+	ip := append([]byte{}, v[4:4+ipLen]...)
+	if xor != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= xor[i]
+		}
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr, port), true
+}
+
+// OutboundIP returns the local IP address that routes to the public internet
+func OutboundIP(useIPv6 bool) (netip.Addr, error) {
+	// No packet is actually sent for "connecting" a UDP socket
+	c, err := net.Dial(tern(useIPv6, "udp6", "udp4"), tern(useIPv6, "[2001:4860:4860::8888]:53", "8.8.8.8:53"))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to find outbound IP: %w", err)
+	}
+	defer func() { _ = c.Close() }()
+	return c.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
+
+func tern[T any](t bool, a T, b T) T {
+	if t {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,50 @@
+package pnet
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestSTUNMappedAddr(t *testing.T) {
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start STUN server: %v", err)
+	}
+	defer func() { _ = server.Close() }()
+	go func() { // mock STUN server replying XOR-MAPPED-ADDRESS
+		buf := make([]byte, 1500)
+		n, from, err := server.ReadFrom(buf)
+		if err != nil || n < stunHeaderLen {
+			return
+		}
+		ua := from.(*net.UDPAddr)
+		rsp := make([]byte, stunHeaderLen+12)
+		binary.BigEndian.PutUint16(rsp[0:], stunBindingResponse)
+		binary.BigEndian.PutUint16(rsp[2:], 12)
+		copy(rsp[4:stunHeaderLen], buf[4:stunHeaderLen])
+		attr := rsp[stunHeaderLen:]
+		binary.BigEndian.PutUint16(attr[0:], stunAttrXorMappedAddr)
+		binary.BigEndian.PutUint16(attr[2:], 8)
+		attr[5] = 0x01
+		binary.BigEndian.PutUint16(attr[6:], uint16(ua.Port)^uint16(stunMagicCookie>>16))
+		for i, b := range ua.IP.To4() {
+			attr[8+i] = b ^ rsp[4+i]
+		}
+		_, _ = server.WriteTo(rsp, from)
+	}()
+
+	client, err := ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func() { _ = client.Close() }()
+	ap, err := STUNMappedAddr(context.Background(), client, server.LocalAddr().String(), false)
+	if err != nil {
+		t.Fatalf("STUN query failed: %v", err)
+	}
+	if ap.String() != client.LocalAddr().String() {
+		t.Fatalf("unexpected mapped address: expect: %v, got: %v", client.LocalAddr(), ap)
+	}
+}
@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by all the streams of a channel
+type rateLimiter struct {
+	rate   float64 // bytes per second
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(bytesPerSec), tokens: float64(bytesPerSec), last: time.Now()}
+}
+
+// wait blocks until n bytes are allowed to pass
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate) - float64(n)
+	l.last = now
+	deficit := -l.tokens
+	l.mu.Unlock()
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
+
+type limitedReader struct {
+	io.Reader
+	limiter *rateLimiter
+}
+
+func (r limitedReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.limiter.wait(n)
+	return
+}
@@ -0,0 +1,252 @@
+// Package relay splices the streams of two peers meeting on the same channel.
+// It is the last resort when neither side can reach the other directly.
+//
+// A peer asks for a relayed stream with an HTTP Upgrade request
+//
+//	GET /relay?chan=<token> HTTP/1.1
+//	Connection: Upgrade
+//	Upgrade: acp-relay
+//
+// and the connection turns into a raw bidirectional stream after
+// "101 Switching Protocols", which is sent as soon as the other peer shows up.
+// The relay never sees the plaintext, since peers encrypt the stream end-to-end.
+package relay
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	upgradeProto = "acp-relay"
+	maxTokenLen  = 128
+)
+
+// Server is an http.Handler that pairs up peers and splices their streams
+type Server struct {
+	// Bytes per second allowed for each channel, in both directions combined; 0 means unlimited
+	RateLimit int64
+	// Maximum lifetime of a spliced channel; 0 means unlimited
+	MaxDuration time.Duration
+	// How long the first peer waits for the second
+	PairTimeout time.Duration
+	// Optional logging
+	Logf func(format string, a ...any)
+
+	mu      sync.Mutex
+	waiting map[string]chan net.Conn
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), upgradeProto) {
+		http.Error(w, "Upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	token := r.URL.Query().Get("chan")
+	if token == "" || len(token) > maxTokenLen {
+		http.Error(w, "Invalid channel", http.StatusBadRequest)
+		return
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "Hijack not supported", http.StatusInternalServerError)
+		return
+	}
+	if n := brw.Reader.Buffered(); n > 0 { // the peer starts talking before the upgrade completes
+		peeked, _ := brw.Peek(n)
+		conn = &bufferedConn{Conn: conn, r: io.MultiReader(strings.NewReader(string(peeked)), conn)}
+	}
+
+	peer, ok := s.pair(r.Context(), token, conn)
+	if !ok {
+		return // the other side of the pair (if any) takes over conn
+	}
+	if peer == nil {
+		s.logf("relay %s: pair timeout", token)
+		msg := "peer did not show up in time"
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 504 Gateway Timeout\r\nConnection: close\r\nContent-Length: %d\r\n\r\n%s", len(msg), msg)
+		_ = conn.Close()
+		return
+	}
+	for _, c := range []net.Conn{conn, peer} {
+		if _, err = io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: "+upgradeProto+"\r\n\r\n"); err != nil {
+			_ = conn.Close()
+			_ = peer.Close()
+			return
+		}
+	}
+	s.logf("relay %s: paired %v <-> %v", token, conn.RemoteAddr(), peer.RemoteAddr())
+	s.splice(conn, peer)
+	s.logf("relay %s: closed", token)
+}
+
+// pair either hands conn over to a waiting peer (returning ok=false), or waits for one
+func (s *Server) pair(ctx context.Context, token string, conn net.Conn) (peer net.Conn, ok bool) {
+	s.mu.Lock()
+	if s.waiting == nil {
+		s.waiting = make(map[string]chan net.Conn)
+	}
+	if ch, found := s.waiting[token]; found {
+		delete(s.waiting, token)
+		s.mu.Unlock()
+		ch <- conn
+		return nil, false
+	}
+	ch := make(chan net.Conn, 1)
+	s.waiting[token] = ch
+	s.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if s.PairTimeout > 0 {
+		timer := time.NewTimer(s.PairTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case peer = <-ch:
+		return peer, true
+	case <-timeout:
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	if s.waiting[token] == ch {
+		delete(s.waiting, token)
+	}
+	s.mu.Unlock()
+	select { // a peer might have arrived just now
+	case peer = <-ch:
+	default:
+	}
+	return peer, true
+}
+
+func (s *Server) splice(a, b net.Conn) {
+	limiter := newRateLimiter(s.RateLimit)
+	closeBoth := sync.OnceFunc(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	if s.MaxDuration > 0 {
+		timer := time.AfterFunc(s.MaxDuration, func() {
+			s.logf("relay: max duration %v reached", s.MaxDuration)
+			closeBoth()
+		})
+		defer timer.Stop()
+	}
+	var wg sync.WaitGroup
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, limitedReader{src, limiter})
+		if err != nil {
+			closeBoth()
+			return
+		}
+		if cw, ok := unwrapConn(dst).(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			closeBoth()
+		}
+	}
+	wg.Add(2)
+	go cp(a, b)
+	go cp(b, a)
+	wg.Wait()
+	closeBoth()
+}
+
+func (s *Server) logf(format string, a ...any) {
+	if s.Logf != nil {
+		s.Logf(format, a...)
+	}
+}
+
+// Dial requests a relayed stream on the channel identified by token.
+// dial is used for the underlying TCP connection.
+func Dial(ctx context.Context, relayURL string, token string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (net.Conn, error) {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay URL %s: %w", relayURL, err)
+	}
+	q := u.Query()
+	q.Set("chan", token)
+	u.RawQuery = q.Encode()
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), map[string]string{"http": "80", "https": "443"}[u.Scheme])
+	}
+
+	conn, err := dial(ctx, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to relay: %w", err)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	if u.Scheme == "https" {
+		tconn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err = tconn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to connect to relay: %w", err)
+		}
+		conn = tconn
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", upgradeProto)
+	if err = req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to send relay request: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("failed to read relay response: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		_ = conn.Close()
+		return nil, fmt.Errorf("relay refused: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if !stop() { // ctx is done and conn is closed
+		return nil, ctx.Err()
+	}
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn is a net.Conn whose reads go through a buffer filled beforehand
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func unwrapConn(c net.Conn) net.Conn {
+	if bc, ok := c.(*bufferedConn); ok {
+		return bc.Conn
+	}
+	return c
+}
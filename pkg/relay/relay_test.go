@@ -0,0 +1,70 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var dialer net.Dialer
+
+func TestRelay(t *testing.T) {
+	server := httptest.NewServer(&Server{PairTimeout: 5 * time.Second, Logf: t.Logf})
+	defer server.Close()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	chResult := make(chan result)
+	for range 2 {
+		go func() {
+			c, err := Dial(context.Background(), server.URL+"/relay", "test-relay", dialer.DialContext)
+			chResult <- result{c, err}
+		}()
+	}
+	ra, rb := <-chResult, <-chResult
+	if ra.err != nil || rb.err != nil {
+		t.Fatalf("relay dial: %v, %v", ra.err, rb.err)
+	}
+
+	data := bytes.Repeat([]byte("acp"), 100000)
+	go func() {
+		_, _ = ra.conn.Write(data)
+		_ = ra.conn.(*bufferedConn).Conn.(*net.TCPConn).CloseWrite()
+	}()
+	got, err := io.ReadAll(rb.conn)
+	if err != nil {
+		t.Fatalf("read from relay: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("data mismatch: sent %d bytes, received %d bytes", len(data), len(got))
+	}
+	_ = ra.conn.Close()
+	_ = rb.conn.Close()
+}
+
+func TestRelayPairTimeout(t *testing.T) {
+	server := httptest.NewServer(&Server{PairTimeout: 100 * time.Millisecond})
+	defer server.Close()
+	_, err := Dial(context.Background(), server.URL+"/relay", "test-relay-timeout", dialer.DialContext)
+	if err == nil || !strings.Contains(err.Error(), "504") {
+		t.Fatalf("expect a pair timeout error, got: %v", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1000)
+	start := time.Now()
+	for range 3 {
+		l.wait(1000)
+	}
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Fatalf("3000 bytes passed a 1000 B/s limiter in %v", elapsed)
+	}
+}
@@ -0,0 +1,54 @@
+package rendezvous
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory pairs up peers within a single process
+type Memory struct {
+	mu    sync.Mutex
+	inbox map[string]*waiter
+}
+
+// waiter is a peer waiting in the inbox for the other peer of its channel
+type waiter struct {
+	x0    []byte
+	reply chan []byte
+}
+
+func (m *Memory) Exchange(ctx context.Context, name string, x0 []byte) ([]byte, error) {
+	m.mu.Lock()
+	if peer, ok := m.inbox[name]; ok { // the other peer is waiting
+		delete(m.inbox, name)
+		m.mu.Unlock()
+		peer.reply <- x0
+		return peer.x0, nil
+	}
+	if m.inbox == nil {
+		m.inbox = make(map[string]*waiter)
+	}
+	me := &waiter{x0: x0, reply: make(chan []byte, 1)}
+	m.inbox[name] = me
+	m.mu.Unlock()
+
+	select {
+	case x1 := <-me.reply:
+		return x1, nil
+	case <-ctx.Done():
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.inbox[name] == me {
+			delete(m.inbox, name)
+			return nil, ctx.Err()
+		}
+		return <-me.reply, nil // the other peer has just taken our message
+	}
+}
+
+// waiting counts the peers in the inbox
+func (m *Memory) waiting() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.inbox)
+}
@@ -0,0 +1,433 @@
+package rendezvous
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cross-instance exchange via a gossip mesh of server nodes, following exchangeViaKV in edge/index.ts.
+// Two peers sharing a channel name meet at a pair of slots, replicated to every node:
+//
+//	slot "a" (host) claimed by whoever arrives first
+//	slot "b" (guest) written by the second peer as its reply
+//
+// The host waits for slot "b" to show up; the guest reads slot "a" directly. Since there is no
+// atomic claim across nodes, concurrent claims are settled by the lowest version (ties broken by
+// the node), and the losing host turns into a guest. Versions come from a hybrid logical clock,
+// so a reply is always newer than the claim it answers. Since a channel name is reused across
+// rounds, every entry carries a TTL as a crash backstop, refreshed by the heartbeat while a host waits.
+//
+// Nodes only take in messages, and the members therein, carrying an HMAC under the shared secret
+// over the time and the body, in both directions. Otherwise anyone could plant entries, or have
+// the node send requests to URLs of their choice.
+
+const (
+	meshEntryTTL      = 30 * time.Second
+	meshHeartbeat     = 10 * time.Second
+	meshSendTimeout   = 2 * time.Second
+	maxMeshMessageLen = 1 << 20
+	maxMeshClockSkew  = meshEntryTTL
+
+	meshMACHeader  = "X-Mesh-MAC"
+	meshTimeHeader = "X-Mesh-Time"
+
+	slotHost  = "a"
+	slotGuest = "b"
+)
+
+// Mesh is an Exchanger pairing up peers within this node in memory, and across the nodes of
+// the mesh via gossip. Mount it at MeshPath of every node, better on a listener apart from the
+// one for clients, and run Run in the background.
+type Mesh struct {
+	// Advertised URL of this node, which also identifies the node
+	Self string
+	// URLs of some other nodes to join the mesh through
+	Seeds []string
+	// Shared by all nodes to authenticate each other; nothing is sent or taken in without it
+	Secret string
+	// Optional logging
+	Logf func(format string, a ...any)
+
+	local  Memory
+	client http.Client
+
+	mu      sync.Mutex
+	clock   uint64
+	members map[string]time.Time // by URL, when last heard from
+	entries map[meshKey]*meshEntry
+	watches map[string][]chan struct{} // by channel name
+}
+
+// MeshPath is where nodes gossip with each other
+const MeshPath = "/v2/mesh"
+
+type meshKey struct{ name, slot, node string }
+
+type meshEntry struct {
+	Name    string `json:"name"`
+	Slot    string `json:"slot"`
+	Node    string `json:"node"`
+	Version uint64 `json:"ver"`
+	// Nil for a deletion, which stays as a tombstone to shadow older versions
+	Value   []byte `json:"value,omitempty"`
+	expires time.Time
+}
+
+func (e *meshEntry) key() meshKey { return meshKey{e.Name, e.Slot, e.Node} }
+
+func (e *meshEntry) live(now time.Time) bool { return e.Value != nil && now.Before(e.expires) }
+
+type meshMessage struct {
+	From    string       `json:"from"`
+	Members []string     `json:"members"`
+	Entries []*meshEntry `json:"entries,omitempty"`
+}
+
+// Exchange races the pairing within this node against the one across the mesh, like exchange in edge/index.ts
+func (m *Mesh) Exchange(ctx context.Context, name string, x0 []byte) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		x1  []byte
+		err error
+	}
+	chResult := make(chan result, 2)
+	for _, exchange := range []func(context.Context, string, []byte) ([]byte, error){m.local.Exchange, m.exchangeViaMesh} {
+		go func() {
+			x1, err := exchange(ctx, name, x0)
+			chResult <- result{x1, err}
+		}()
+	}
+	var errs []error
+	for range 2 {
+		res := <-chResult
+		if res.err == nil {
+			return res.x1, nil // the deferred cancel withdraws the other
+		}
+		errs = append(errs, res.err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (m *Mesh) exchangeViaMesh(ctx context.Context, name string, x0 []byte) ([]byte, error) {
+	m.mu.Lock()
+	if host := m.hostOf(name); host != nil {
+		// A peer already hosts this exchange
+		reply := m.put(&meshEntry{Name: name, Slot: slotGuest, Node: m.Self, Version: m.tick(), Value: x0})
+		m.mu.Unlock()
+		m.broadcast(reply)
+		return host.Value, nil
+	}
+
+	// We host this exchange
+	claim := m.put(&meshEntry{Name: name, Slot: slotHost, Node: m.Self, Version: m.tick(), Value: x0})
+	watch := make(chan struct{}, 1)
+	m.watches[name] = append(m.watches[name], watch)
+	m.mu.Unlock()
+	m.broadcast(claim)
+
+	var toDelete []*meshEntry
+	defer func() {
+		// The host finishes last, so tear down both slots
+		m.mu.Lock()
+		m.watches[name] = slices.DeleteFunc(m.watches[name], func(w chan struct{}) bool { return w == watch })
+		if len(m.watches[name]) == 0 {
+			delete(m.watches, name)
+		}
+		var deletions []*meshEntry
+		for _, e := range append(toDelete, claim) {
+			deletions = append(deletions, m.put(&meshEntry{Name: e.Name, Slot: e.Slot, Node: e.Node, Version: max(m.tick(), e.Version+1)}))
+		}
+		m.mu.Unlock()
+		m.broadcast(deletions...)
+	}()
+	for {
+		m.mu.Lock()
+		if host := m.hostOf(name); host != nil && host.key() != claim.key() {
+			// A concurrent claim elsewhere wins, so we turn into its guest
+			reply := m.put(&meshEntry{Name: name, Slot: slotGuest, Node: m.Self, Version: m.tick(), Value: x0})
+			m.mu.Unlock()
+			m.broadcast(reply)
+			return host.Value, nil
+		}
+		// Only accept a reply newer than our claim so a leftover from a previous round is ignored
+		if reply := m.replyTo(claim); reply != nil {
+			m.mu.Unlock()
+			toDelete = append(toDelete, reply)
+			return reply.Value, nil
+		}
+		m.mu.Unlock()
+		select {
+		case <-watch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// hostOf finds the winning claim of the channel, if any
+func (m *Mesh) hostOf(name string) (host *meshEntry) {
+	now := time.Now()
+	for _, e := range m.entries {
+		if e.Name != name || e.Slot != slotHost || !e.live(now) {
+			continue
+		}
+		if host == nil || e.Version < host.Version || (e.Version == host.Version && e.Node < host.Node) {
+			host = e
+		}
+	}
+	return
+}
+
+// replyTo finds the earliest reply newer than the claim
+func (m *Mesh) replyTo(claim *meshEntry) (reply *meshEntry) {
+	now := time.Now()
+	for _, e := range m.entries {
+		if e.Name != claim.Name || e.Slot != slotGuest || !e.live(now) || e.Version <= claim.Version {
+			continue
+		}
+		if reply == nil || e.Version < reply.Version {
+			reply = e
+		}
+	}
+	return
+}
+
+// put stores the entry unless shadowed by a newer version, and wakes up the hosts watching the channel.
+// It returns the entry for broadcasting.
+func (m *Mesh) put(e *meshEntry) *meshEntry {
+	if m.entries == nil {
+		m.entries = make(map[meshKey]*meshEntry)
+		m.watches = make(map[string][]chan struct{})
+	}
+	m.clock = max(m.clock, e.Version)
+	if old, ok := m.entries[e.key()]; ok && old.Version > e.Version {
+		return e
+	}
+	e.expires = time.Now().Add(meshEntryTTL)
+	m.entries[e.key()] = e
+	for _, w := range m.watches[e.Name] {
+		select {
+		case w <- struct{}{}:
+		default:
+		}
+	}
+	return e
+}
+
+// tick advances the hybrid logical clock, which stays ahead of every version seen
+func (m *Mesh) tick() uint64 {
+	m.clock = max(m.clock+1, uint64(time.Now().UnixNano()))
+	return m.clock
+}
+
+// Run keeps the node in the mesh, sending heartbeats until ctx is done
+func (m *Mesh) Run(ctx context.Context) {
+	ticker := time.NewTicker(meshHeartbeat)
+	defer ticker.Stop()
+	for {
+		m.heartbeat()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// heartbeat drops what has expired, and refreshes our claims on all other nodes,
+// which also tells them that we are alive
+func (m *Mesh) heartbeat() {
+	now := time.Now()
+	var claims []*meshEntry
+	m.mu.Lock()
+	for k, e := range m.entries {
+		switch {
+		case !now.Before(e.expires):
+			delete(m.entries, k)
+		case e.Node == m.Self && e.Slot == slotHost && e.Value != nil:
+			e.expires = now.Add(meshEntryTTL)
+			claims = append(claims, e)
+		}
+	}
+	for u, seen := range m.members {
+		if now.Sub(seen) > meshEntryTTL && !slices.Contains(m.Seeds, u) {
+			m.logf("mesh: lost node %s", u)
+			delete(m.members, u)
+		}
+	}
+	m.mu.Unlock()
+	m.broadcast(claims...)
+}
+
+// broadcast sends the entries, along with the members we know, to all other nodes
+func (m *Mesh) broadcast(entries ...*meshEntry) {
+	m.mu.Lock()
+	targets := slices.Clone(m.Seeds)
+	for u := range m.members {
+		if !slices.Contains(targets, u) {
+			targets = append(targets, u)
+		}
+	}
+	targets = slices.DeleteFunc(targets, func(u string) bool { return u == m.Self })
+	msg, _ := json.Marshal(&meshMessage{From: m.Self, Members: append(slices.Clone(targets), m.Self), Entries: entries})
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, u := range targets {
+		wg.Go(func() {
+			if err := m.send(u, msg); err != nil {
+				m.logf("mesh: failed to reach %s: %v", u, err)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func (m *Mesh) send(node string, msg []byte) error {
+	if m.Secret == "" {
+		return errNoMeshSecret
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), meshSendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(node, "/")+MeshPath, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	m.sign(req.Header, msg)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("node responded with %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxMeshMessageLen))
+	if err != nil {
+		return err
+	}
+	if err = m.verify(resp.Header, body); err != nil {
+		return fmt.Errorf("unauthenticated reply: %w", err)
+	}
+	var reply meshMessage
+	if err = json.Unmarshal(body, &reply); err != nil {
+		return err
+	}
+	m.merge(&reply)
+	return nil
+}
+
+// ServeHTTP receives gossip from other nodes
+func (m *Mesh) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxMeshMessageLen))
+	if err != nil {
+		http.Error(w, "Invalid message", http.StatusBadRequest)
+		return
+	}
+	if err = m.verify(r.Header, body); err != nil {
+		m.logf("mesh: rejected message from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var msg meshMessage
+	if err = json.Unmarshal(body, &msg); err != nil || msg.From == "" {
+		http.Error(w, "Invalid message", http.StatusBadRequest)
+		return
+	}
+
+	m.merge(&msg)
+
+	// Reply with the members we know, so that the sender learns about them as well
+	m.mu.Lock()
+	members := append(slices.Collect(maps.Keys(m.members)), m.Self)
+	m.mu.Unlock()
+	reply, _ := json.Marshal(&meshMessage{From: m.Self, Members: members})
+	w.Header().Set("Content-Type", "application/json")
+	m.sign(w.Header(), reply)
+	_, _ = w.Write(reply)
+}
+
+var errNoMeshSecret = errors.New("no secret is set for the mesh")
+
+// sign adds the MAC of the message to the headers
+func (m *Mesh) sign(h http.Header, body []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	h.Set(meshTimeHeader, ts)
+	h.Set(meshMACHeader, m.mac(ts, body))
+}
+
+// verify checks the MAC of the message, and that it is recent
+func (m *Mesh) verify(h http.Header, body []byte) error {
+	if m.Secret == "" {
+		return errNoMeshSecret
+	}
+	ts := h.Get(meshTimeHeader)
+	if !hmac.Equal([]byte(h.Get(meshMACHeader)), []byte(m.mac(ts, body))) {
+		return errors.New("invalid MAC")
+	}
+	sec, _ := strconv.ParseInt(ts, 10, 64)
+	if skew := time.Since(time.Unix(sec, 0)); skew > maxMeshClockSkew || skew < -maxMeshClockSkew {
+		return fmt.Errorf("stale message (clock skew %v)", skew)
+	}
+	return nil
+}
+
+func (m *Mesh) mac(ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(m.Secret))
+	mac.Write([]byte(ts + "|"))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// merge takes in the members and entries from a message of another node
+func (m *Mesh) merge(msg *meshMessage) {
+	if msg.From == "" {
+		return
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.members == nil {
+		m.members = make(map[string]time.Time)
+	}
+	if _, ok := m.members[msg.From]; !ok {
+		m.logf("mesh: joined by node %s", msg.From)
+	}
+	m.members[msg.From] = now
+	for _, u := range msg.Members {
+		if _, ok := m.members[u]; !ok && u != m.Self {
+			m.members[u] = now // until proven otherwise by its silence
+		}
+	}
+	for _, e := range msg.Entries {
+		if e.Name != "" && (e.Slot == slotHost || e.Slot == slotGuest) {
+			m.put(e)
+		}
+	}
+}
+
+func (m *Mesh) logf(format string, a ...any) {
+	if m.Logf != nil {
+		m.Logf(format, a...)
+	}
+}
@@ -0,0 +1,182 @@
+package rendezvous
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/contextualist/acp/pkg/pnet"
+)
+
+// newTestMesh starts n nodes, each seeded with the first node, and serving the rendezvous and the gossip apart
+func newTestMesh(t *testing.T, n int) ([]*Mesh, []*httptest.Server) {
+	meshes := make([]*Mesh, n)
+	servers := make([]*httptest.Server, n)
+	for i := range n {
+		meshes[i] = newTestMeshNode(t, "test-secret")
+		if i > 0 {
+			meshes[i].Seeds = []string{meshes[0].Self}
+		}
+		servers[i] = httptest.NewServer(&Server{Exchanger: meshes[i], Logf: t.Logf})
+		t.Cleanup(servers[i].Close)
+	}
+	for range 2 { // join via the seed, then meet the others
+		for _, m := range meshes {
+			m.heartbeat()
+		}
+	}
+	return meshes, servers
+}
+
+func TestMeshExchange(t *testing.T) {
+	pnet.SetLogger(&testLogger{t})
+	meshes, servers := newTestMesh(t, 3)
+	for i, m := range meshes {
+		if len(m.members) != 2 {
+			t.Fatalf("node %d knows %d other nodes", i, len(m.members))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Peers of each pair reach different nodes, and the host arrives either first or at the same time
+	for round, nodes := range [][2]int{{1, 2}, {2, 1}, {0, 1}, {1, 2}} {
+		type result struct {
+			nonce string
+			peer  *pnet.PeerInfo
+			err   error
+		}
+		chResult := make(chan result)
+		for i, node := range nodes {
+			go func() {
+				nonce := fmt.Sprintf("%d-%d", round, i)
+				self := &pnet.SelfInfo{ChanName: "test-mesh", RelayNonce: nonce}
+				info, err := pnet.ExchangeConnInfo(ctx, servers[node].URL+"/v2/exchange", self, 0, false)
+				chResult <- result{nonce, info, err}
+			}()
+		}
+		ra, rb := <-chResult, <-chResult
+		if ra.err != nil || rb.err != nil {
+			t.Fatalf("round %d: exchange: %v, %v", round, ra.err, rb.err)
+		}
+		if ra.peer.RelayNonce != rb.nonce || rb.peer.RelayNonce != ra.nonce {
+			t.Fatalf("round %d: peers mismatched: %s got %s, %s got %s", round, ra.nonce, ra.peer.RelayNonce, rb.nonce, rb.peer.RelayNonce)
+		}
+	}
+	// No live claim is left behind for the next round
+	for i, m := range meshes {
+		waitFor(t, func() bool {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return m.hostOf("test-mesh") == nil
+		})
+		t.Logf("node %d settled", i)
+	}
+}
+
+func TestMeshConcurrentClaims(t *testing.T) {
+	meshes, _ := newTestMesh(t, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Both claim before hearing from each other, and the losing claim turns into a guest
+	replies := make(chan []byte)
+	for i, m := range meshes {
+		go func() {
+			x1, err := m.exchangeViaMesh(ctx, "test-concurrent", []byte{byte(i)})
+			if err != nil {
+				t.Errorf("node %d: %v", i, err)
+			}
+			replies <- x1
+		}()
+	}
+	r0, r1 := <-replies, <-replies
+	if !(bytes.Equal(r0, []byte{0}) && bytes.Equal(r1, []byte{1})) && !(bytes.Equal(r0, []byte{1}) && bytes.Equal(r1, []byte{0})) {
+		t.Fatalf("unexpected replies: %v, %v", r0, r1)
+	}
+}
+
+func TestMeshWithdraw(t *testing.T) {
+	meshes, _ := newTestMesh(t, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A host gives up, and a later peer must not take its claim
+	ctx1, cancel1 := context.WithCancel(ctx)
+	chErr := make(chan error)
+	go func() {
+		_, err := meshes[0].exchangeViaMesh(ctx1, "test-withdraw", []byte("stale"))
+		chErr <- err
+	}()
+	hosted := func(m *Mesh) func() bool {
+		return func() bool {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return m.hostOf("test-withdraw") != nil
+		}
+	}
+	waitFor(t, hosted(meshes[1]))
+	cancel1()
+	if err := <-chErr; err == nil {
+		t.Fatalf("cancelled exchange succeeded")
+	}
+	waitFor(t, func() bool { return !hosted(meshes[1])() })
+
+	go func() {
+		_, _ = meshes[0].Exchange(ctx, "test-withdraw", []byte("fresh"))
+	}()
+	waitFor(t, hosted(meshes[1]))
+	x1, err := meshes[1].Exchange(ctx, "test-withdraw", []byte("guest"))
+	if err != nil || string(x1) != "fresh" {
+		t.Fatalf("unexpected reply after a withdrawal: %q, %v", x1, err)
+	}
+}
+
+func newTestMeshNode(t *testing.T, secret string) *Mesh {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	m := &Mesh{Self: server.URL, Secret: secret, Logf: t.Logf}
+	mux.Handle(MeshPath, m)
+	return m
+}
+
+func TestMeshRejectUnauthorized(t *testing.T) {
+	meshes, _ := newTestMesh(t, 1)
+	msg := []byte(`{"from":"http://evil","members":["http://169.254.169.254"]}`)
+	forged := &Mesh{Secret: "wrong-secret"}
+	for _, sign := range []func(http.Header){
+		func(http.Header) {},
+		func(h http.Header) { h.Set("Authorization", "Bearer test-secret") },
+		func(h http.Header) { forged.sign(h, msg) },
+	} {
+		req, _ := http.NewRequest(http.MethodPost, meshes[0].Self+MeshPath, bytes.NewReader(msg))
+		sign(req.Header)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expect %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+	}
+	if len(meshes[0].members) != 0 {
+		t.Fatalf("members taken from an unauthenticated message: %v", meshes[0].members)
+	}
+}
+
+func TestMeshRequireSecret(t *testing.T) {
+	// A node without the secret neither joins nor is joined, and nothing is learned from the replies
+	a, b := newTestMeshNode(t, "test-secret"), newTestMeshNode(t, "")
+	b.Seeds = []string{a.Self}
+	b.heartbeat()
+	a.Seeds = []string{b.Self}
+	a.heartbeat()
+	if len(a.members) != 0 || len(b.members) != 0 {
+		t.Fatalf("joined without the secret: %v, %v", a.members, b.members)
+	}
+}
@@ -0,0 +1,235 @@
+// Package rendezvous is the server where two peers sharing a channel name swap their connection info.
+// It is a Go port of edge/index.ts, speaking the same protocol:
+//
+// A peer POSTs to /v2/exchange (or the legacy /exchange) a packet with its info, framed by a
+// big-endian uint16 length, and keeps the request body open. The server replies, once the other
+// peer of the channel shows up, with a packet of the other peer's info, plus the public address
+// it observes. Sending any byte (0xff by convention) or closing the request body while waiting
+// withdraws from the exchange.
+//
+// A channel named after a public key is authenticated: the info must carry a proof signed by the
+// matching private key (see pnet.VerifyChannel), so that no stranger can squat or join it.
+package rendezvous
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/contextualist/acp/pkg/pnet"
+)
+
+const (
+	// Larger packets are rejected as suspicious. Keep in sync with lenCap in edge/index.ts,
+	// raised from 1000 for the dual-stack candidates.
+	maxPacketLen = 4000
+
+	installScript = `
+          curl -fsSL "https://bina.egoist.dev/contextualist/acp%s" | sh
+          if [ $# -eq 0 ]; then acp --setup; else acp "$@"; fi
+        `
+)
+
+// Server is an http.Handler serving the rendezvous endpoints
+type Server struct {
+	// Pairing of peers, defaults to a Memory for a single instance
+	Exchanger Exchanger
+	// Optional logging
+	Logf func(format string, a ...any)
+	// Take the address of the client from the headers X-Real-IP (or the last entry of X-Forwarded-For)
+	// and X-Real-Port, as set by a reverse proxy in front. Only to be enabled behind one.
+	TrustProxy bool
+
+	once sync.Once
+}
+
+// Exchanger pairs up the two peers on a channel, swapping their messages
+type Exchanger interface {
+	// Exchange offers x0 on the channel, returning the message of the other peer,
+	// or an error if ctx is done first
+	Exchange(ctx context.Context, name string, x0 []byte) ([]byte, error)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/get":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		search := ""
+		if r.URL.RawQuery != "" {
+			search = "?" + r.URL.RawQuery
+		}
+		_, _ = fmt.Fprintf(w, installScript, search)
+	case "/v2/exchange":
+		s.handleExchange(w, r, exchangeV2)
+	case "/v2/whoami":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = io.WriteString(w, s.remoteAddr(r))
+	case "/exchange":
+		s.handleExchange(w, r, exchangeV1)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// handleExchange runs the common part of both versions of the exchange, where parse turns the
+// client's packet into the channel name and the message for the other peer
+func (s *Server) handleExchange(w http.ResponseWriter, r *http.Request, parse func(pkt []byte, pubAddr string) (string, []byte, error)) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/octet-stream" {
+		http.Error(w, "Invalid content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	// The request body stays open for the client to withdraw, while we reply
+	_ = http.NewResponseController(w).EnableFullDuplex()
+
+	pkt, err := receivePacket(r.Body)
+	if err != nil {
+		s.logf("bad packet from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "Invalid packet", http.StatusBadRequest)
+		return
+	}
+	name, x0, err := parse(pkt, s.remoteAddr(r))
+	if errors.Is(err, errForbidden) {
+		s.logf("rejected %s: %v", r.RemoteAddr, err)
+		http.Error(w, "Invalid channel proof", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		s.logf("bad info from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "Invalid info", http.StatusBadRequest)
+		return
+	}
+
+	s.once.Do(func() {
+		if s.Exchanger == nil {
+			s.Exchanger = &Memory{}
+		}
+	})
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		// The client sends anything more, or closes the request body, to withdraw
+		_, _ = r.Body.Read(make([]byte, 1))
+		cancel()
+	}()
+	x1, err := s.Exchanger.Exchange(ctx, name, x0)
+	if err != nil {
+		s.logf("exchange %s: %v", name, err)
+		return // empty reply
+	}
+	_ = sendPacket(w, x1)
+}
+
+// remoteAddr is the public address of the client, as seen by the reverse proxy if trusted
+func (s *Server) remoteAddr(r *http.Request) string {
+	if !s.TrustProxy {
+		return r.RemoteAddr
+	}
+	host := strings.TrimSpace(r.Header.Get("X-Real-IP"))
+	if host == "" {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			hops := strings.Split(fwd[len(fwd)-1], ",")
+			host = strings.TrimSpace(hops[len(hops)-1]) // appended by the proxy in front of us
+		}
+	}
+	port := strings.TrimSpace(r.Header.Get("X-Real-Port"))
+	ip, err := netip.ParseAddr(host)
+	if err != nil || port == "" {
+		s.logf("missing or invalid client address from the proxy (X-Real-IP %q, X-Real-Port %q), using %s", host, port, r.RemoteAddr)
+		return r.RemoteAddr
+	}
+	return net.JoinHostPort(ip.Unmap().String(), port)
+}
+
+// errForbidden rejects a client failing to prove its channel
+var errForbidden = errors.New("forbidden")
+
+// exchangeV2 keeps the client's info except for the fields meant for the server,
+// adding the addresses of the client and the number of plans
+func exchangeV2(pkt []byte, pubAddr string) (string, []byte, error) {
+	var info map[string]json.RawMessage
+	if err := json.Unmarshal(pkt, &info); err != nil {
+		return "", nil, err
+	}
+	var self pnet.SelfInfo
+	if err := json.Unmarshal(pkt, &self); err != nil {
+		return "", nil, err
+	}
+	if err := pnet.VerifyChannel(&self); err != nil {
+		return "", nil, fmt.Errorf("%w: %v", errForbidden, err)
+	}
+	var priAddr, chanName string
+	if err := json.Unmarshal(info["priAddr"], &priAddr); err != nil {
+		return "", nil, fmt.Errorf("invalid priAddr: %w", err)
+	}
+	if err := json.Unmarshal(info["chanName"], &chanName); err != nil {
+		return "", nil, fmt.Errorf("invalid chanName: %w", err)
+	}
+	nPlan := json.RawMessage("1")
+	if n, ok := info["nPlan"]; ok {
+		nPlan = n
+	}
+	delete(info, "priAddr")
+	delete(info, "chanName")
+	delete(info, "nPlan")
+	info["peerAddrs"], _ = json.Marshal([]map[string]string{{"pubAddr": pubAddr, "priAddr": priAddr}})
+	info["peerNPlan"] = nPlan
+	reply, err := json.Marshal(info)
+	return chanName, reply, err
+}
+
+// exchangeV1 turns "priAddr|chanName" into "pubAddr|priAddr". It has no room for a proof,
+// so an authenticated channel is off limits.
+func exchangeV1(pkt []byte, pubAddr string) (string, []byte, error) {
+	for i, b := range pkt {
+		if b == '|' {
+			name := string(pkt[i+1:])
+			if pnet.IsAuthenticatedChannel(name) {
+				return "", nil, fmt.Errorf("%w: authenticated channel %s over the legacy exchange", errForbidden, name)
+			}
+			return name, fmt.Appendf(nil, "%s|%s", pubAddr, pkt[:i]), nil
+		}
+	}
+	return "", nil, errors.New("missing separator")
+}
+
+func receivePacket(r io.Reader) ([]byte, error) {
+	var plen uint16
+	if err := binary.Read(r, binary.BigEndian, &plen); err != nil {
+		return nil, err
+	}
+	if plen == 0 || plen > maxPacketLen {
+		return nil, fmt.Errorf("suspicious packet header declaring len=%d", plen)
+	}
+	buf := make([]byte, plen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func sendPacket(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint16(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func (s *Server) logf(format string, a ...any) {
+	if s.Logf != nil {
+		s.Logf(format, a...)
+	}
+}
@@ -0,0 +1,226 @@
+package rendezvous
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/contextualist/acp/pkg/pnet"
+)
+
+type testLogger struct{ t *testing.T }
+
+func (l *testLogger) Infof(format string, a ...any)  { l.t.Logf(format, a...) }
+func (l *testLogger) Debugf(format string, a ...any) { l.t.Logf(format, a...) }
+
+func TestExchange(t *testing.T) {
+	pnet.SetLogger(&testLogger{t})
+	server := httptest.NewServer(&Server{Logf: t.Logf})
+	defer server.Close()
+
+	type result struct {
+		self *pnet.SelfInfo
+		peer *pnet.PeerInfo
+		err  error
+	}
+	// The client keeps the request body open only with a cancellable context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	chResult := make(chan result)
+	for _, strategy := range []string{"tcp_punch", "relay"} {
+		go func() {
+			self := &pnet.SelfInfo{ChanName: "test-exchange", Strategy: []string{strategy}, NPlan: 2, RelayNonce: strategy}
+			info, err := pnet.ExchangeConnInfo(ctx, server.URL+"/v2/exchange", self, 0, false)
+			chResult <- result{self, info, err}
+		}()
+	}
+	ra, rb := <-chResult, <-chResult
+	if ra.err != nil || rb.err != nil {
+		t.Fatalf("exchange: %v, %v", ra.err, rb.err)
+	}
+	for _, c := range [][2]result{{ra, rb}, {rb, ra}} {
+		self, peer := c[0].self, c[1].peer
+		if len(peer.PeerAddrs) != 1 || peer.PeerAddrs[0].PriAddr != self.PriAddr || peer.PeerAddrs[0].PubAddr != self.PriAddr {
+			t.Errorf("unexpected peer addresses: expect %s, got %+v", self.PriAddr, peer.PeerAddrs)
+		}
+		if peer.PeerNPlan != 2 || peer.Strategy[0] != self.Strategy[0] || peer.RelayNonce != self.RelayNonce {
+			t.Errorf("peer info not passed through: sent %+v, got %+v", *self, *peer)
+		}
+	}
+}
+
+func TestExchangeAuthenticated(t *testing.T) {
+	pnet.SetLogger(&testLogger{t})
+	server := httptest.NewServer(&Server{Logf: t.Logf})
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exchange := func(psk string) (*pnet.PeerInfo, error) {
+		var self pnet.SelfInfo
+		self.Authenticate("AAAAAAAA", []byte(psk), false)
+		return pnet.ExchangeConnInfo(ctx, server.URL+"/v2/exchange", &self, 0, false)
+	}
+
+	// A stranger learning the channel name cannot get into the channel without the PSK
+	var legit pnet.SelfInfo
+	legit.Authenticate("AAAAAAAA", []byte("psk"), false)
+	squatter := &pnet.SelfInfo{ChanName: legit.ChanName}
+	if _, err := pnet.ExchangeConnInfo(ctx, server.URL+"/v2/exchange", squatter, 0, false); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("squatter not rejected: %v", err)
+	}
+
+	chErr := make(chan error)
+	for range 2 {
+		go func() {
+			_, err := exchange("psk")
+			chErr <- err
+		}()
+	}
+	if err1, err2 := <-chErr, <-chErr; err1 != nil || err2 != nil {
+		t.Fatalf("authenticated exchange: %v, %v", err1, err2)
+	}
+}
+
+func TestExchangeEarlyClose(t *testing.T) {
+	pnet.SetLogger(&testLogger{t})
+	mem := &Memory{}
+	server := httptest.NewServer(&Server{Exchanger: mem, Logf: t.Logf})
+	defer server.Close()
+	exchange := func(ctx context.Context) (*pnet.PeerInfo, error) {
+		return pnet.ExchangeConnInfo(ctx, server.URL+"/v2/exchange", &pnet.SelfInfo{ChanName: "test-early-close"}, 0, false)
+	}
+
+	// A client gives up waiting, and the next two pair up with each other
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx1, cancel1 := context.WithCancel(ctx)
+	chErr := make(chan error)
+	go func() {
+		_, err := exchange(ctx1)
+		chErr <- err
+	}()
+	waitFor(t, func() bool { return mem.waiting() == 1 })
+	cancel1()
+	if err := <-chErr; err == nil {
+		t.Fatalf("cancelled exchange succeeded")
+	}
+	waitFor(t, func() bool { return mem.waiting() == 0 })
+
+	chInfo := make(chan *pnet.PeerInfo)
+	for range 2 {
+		go func() {
+			info, err := exchange(ctx)
+			if err != nil {
+				t.Errorf("exchange after an early close: %v", err)
+			}
+			chInfo <- info
+		}()
+	}
+	<-chInfo
+	<-chInfo
+}
+
+func TestExchangeV1(t *testing.T) {
+	server := httptest.NewServer(&Server{Logf: t.Logf})
+	defer server.Close()
+
+	priAddrs := []string{"192.168.1.2:9000", "192.168.1.3:9000"}
+	replies := make([]string, len(priAddrs))
+	var wg sync.WaitGroup
+	for i, priAddr := range priAddrs {
+		wg.Go(func() {
+			body, bodyWriter := io.Pipe()
+			defer func() { _ = bodyWriter.Close() }()
+			go func() { _ = sendPacket(bodyWriter, []byte(priAddr+"|test-v1")) }()
+			resp, err := http.Post(server.URL+"/exchange", "application/octet-stream", body)
+			if err != nil {
+				t.Errorf("v1 exchange: %v", err)
+				return
+			}
+			defer func() { _ = resp.Body.Close() }()
+			reply, err := receivePacket(resp.Body)
+			if err != nil {
+				t.Errorf("v1 reply: %v", err)
+			}
+			replies[i] = string(reply)
+		})
+	}
+	wg.Wait()
+	for i := range priAddrs {
+		pubAddr, priAddr, _ := strings.Cut(replies[i], "|")
+		if !strings.HasPrefix(pubAddr, "127.0.0.1:") || priAddr != priAddrs[1-i] {
+			t.Errorf("unexpected v1 reply to %s: %q", priAddrs[i], replies[i])
+		}
+	}
+}
+
+func TestRejectInvalid(t *testing.T) {
+	server := httptest.NewServer(&Server{Logf: t.Logf})
+	defer server.Close()
+	for _, c := range []struct {
+		method, path, contentType, body string
+		expect                          int
+	}{
+		{"GET", "/v2/exchange", "application/octet-stream", "", http.StatusMethodNotAllowed},
+		{"POST", "/v2/exchange", "text/plain", "", http.StatusUnsupportedMediaType},
+		{"POST", "/v2/exchange", "application/octet-stream", "\x00\x00", http.StatusBadRequest},
+		{"POST", "/v2/exchange", "application/octet-stream", "\xff\xff", http.StatusBadRequest},
+		// An authenticated channel over the legacy exchange, which cannot carry the proof
+		{"POST", "/exchange", "application/octet-stream", "\x00\x1e192.168.1.2:9000|k.AAAAAAAAAAA", http.StatusForbidden},
+		{"GET", "/nowhere", "", "", http.StatusNotFound},
+		{"GET", "/get", "", "", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(c.method, server.URL+c.path, strings.NewReader(c.body))
+		req.Header.Set("Content-Type", c.contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", c.method, c.path, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != c.expect {
+			t.Errorf("%s %s (%q): expect %d, got %d", c.method, c.path, c.body, c.expect, resp.StatusCode)
+		}
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for range 100 {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("condition not met in time")
+}
+
+func TestWhoamiTrustProxy(t *testing.T) {
+	for _, c := range []struct {
+		trust   bool
+		headers map[string]string
+		expect  string // empty for the address of the connection
+	}{
+		{false, map[string]string{"X-Real-IP": "1.2.3.4", "X-Real-Port": "5678"}, ""},
+		{true, map[string]string{"X-Real-IP": "1.2.3.4", "X-Real-Port": "5678"}, "1.2.3.4:5678"},
+		{true, map[string]string{"X-Forwarded-For": "10.0.0.1, 2001:db8::1", "X-Real-Port": "5678"}, "[2001:db8::1]:5678"},
+		{true, map[string]string{"X-Real-IP": "1.2.3.4"}, ""},
+	} {
+		req := httptest.NewRequest("GET", "/v2/whoami", nil)
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		(&Server{Logf: t.Logf, TrustProxy: c.trust}).ServeHTTP(w, req)
+		expect := c.expect
+		if expect == "" {
+			expect = req.RemoteAddr
+		}
+		if got := w.Body.String(); got != expect {
+			t.Errorf("trust %v, headers %v: expect %s, got %s", c.trust, c.headers, expect, got)
+		}
+	}
+}
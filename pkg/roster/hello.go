@@ -0,0 +1,128 @@
+package roster
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Hello is what a device presents to its peer once the session is set up
+type Hello struct {
+	Device Device `json:"device"`
+	// Signature over the binding of the session, so that the hello cannot be replayed elsewhere
+	Sig    []byte  `json:"sig"`
+	Roster *Roster `json:"roster,omitempty"`
+	// Why the peer is refused, in place of the rest
+	Refusal string `json:"refusal,omitempty"`
+}
+
+// Hello presents this device for the session identified by binding
+func (g *Group) Hello(binding []byte) *Hello {
+	r := g.Roster()
+	r.Pending, r.Seeding = nil, false
+	return &Hello{Device: g.Self, Sig: ed25519.Sign(g.key, binding), Roster: &r}
+}
+
+// Accept authenticates the peer for the session identified by binding, and merges its roster into ours.
+// It returns the peer as named in our roster. A peer not on the roster is turned away, and held for approval.
+func (g *Group) Accept(binding []byte, h *Hello) (*Device, error) {
+	return g.accept(binding, h, false)
+}
+
+// Enroll is Accept for the session inviting the peer, where a peer new to the group is endorsed by this device
+func (g *Group) Enroll(binding []byte, h *Hello) (*Device, error) {
+	return g.accept(binding, h, true)
+}
+
+// Join is Accept for the session joining the group of the peer. The roster of the peer, which must
+// endorse this device, replaces ours, to be saved by Save once the rest of joining succeeds.
+func (g *Group) Join(binding []byte, h *Hello) (*Device, error) {
+	if err := verify(binding, h); err != nil {
+		return nil, err
+	}
+	if h.Roster == nil || !h.Roster.endorses(g.Self.Key) || h.Roster.find(h.Device.Key) < 0 {
+		return nil, errors.New("this device is not endorsed by the inviting device")
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.roster = Roster{Devices: slices.Clone(h.Roster.Devices), Revoked: slices.Clone(h.Roster.Revoked)}
+	g.roster.sign(g.key)
+	peer := g.roster.Devices[g.roster.find(h.Device.Key)]
+	return &peer, nil
+}
+
+// verify checks the hello for the session identified by binding, along with the roster therein, if any
+func verify(binding []byte, h *Hello) error {
+	if h.Refusal != "" {
+		return fmt.Errorf("refused by peer: %s", h.Refusal)
+	}
+	if len(h.Device.Key) != ed25519.PublicKeySize {
+		return errors.New("peer presents no device key")
+	}
+	if !ed25519.Verify(h.Device.Key, binding, h.Sig) {
+		return errors.New("invalid device signature from peer")
+	}
+	// Only the roster of the peer itself is taken
+	if h.Roster != nil && (h.Roster.Verify() != nil || !bytes.Equal(h.Roster.Signer, h.Device.Key)) {
+		return errors.New("invalid roster from peer")
+	}
+	return nil
+}
+
+func (g *Group) accept(binding []byte, h *Hello, enroll bool) (*Device, error) {
+	if err := verify(binding, h); err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.roster.revoked(h.Device.Key) {
+		return nil, fmt.Errorf("device %s (%s) has been revoked", h.Device.Name, h.Device.Fingerprint())
+	}
+
+	changed := false
+	if enroll {
+		changed = g.roster.add(vouch(h.Device, g.key, endorsement))
+	}
+	if h.Roster != nil {
+		if len(g.roster.Devices) == 1 && len(g.roster.Revoked) == 0 && h.Roster.endorses(g.Self.Key) {
+			// On its own, this device joins the group of the peer endorsing it
+			g.roster.Devices, g.roster.Revoked = slices.Clone(h.Roster.Devices), slices.Clone(h.Roster.Revoked)
+			changed = true
+		} else {
+			if g.roster.Seeding {
+				// As devices took in any peer holding the PSK before the roster, the first one met is taken
+				// on the word of the PSK, so that devices upgraded from then keep working with each other
+				changed = g.roster.add(vouch(h.Device, g.key, endorsement)) || changed
+			}
+			changed = g.roster.merge(h.Roster) || changed
+		}
+	}
+	i := g.roster.find(h.Device.Key)
+	if i < 0 && !g.roster.revoked(h.Device.Key) {
+		g.roster.hold(h.Device)
+		changed = true
+	}
+	if i >= 0 && g.roster.Seeding {
+		g.roster.Seeding, changed = false, true
+	}
+	if changed {
+		g.roster.Pending = slices.DeleteFunc(g.roster.Pending, func(d Device) bool { return g.roster.find(d.Key) >= 0 })
+		g.roster.sign(g.key)
+		if err := g.save(); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case g.roster.revoked(g.Self.Key):
+		return nil, errors.New("this device has been revoked by the group")
+	case g.roster.revoked(h.Device.Key):
+		return nil, fmt.Errorf("device %s (%s) has been revoked", h.Device.Name, h.Device.Fingerprint())
+	case i < 0:
+		return nil, fmt.Errorf("device %s (%s) is not on the roster; to let it in, run `acp devices approve %s` on this device, or set it up with `acp invite`",
+			h.Device.Name, h.Device.Fingerprint(), h.Device.Name)
+	}
+	peer := g.roster.Devices[i]
+	return &peer, nil
+}
@@ -0,0 +1,317 @@
+// Package roster keeps track of the devices sharing a config, each with its own key and name.
+//
+// The roster lists the devices known to the group and those revoked, signed by the device that
+// last changed it. On every transfer, both ends present their device keys bound to the session,
+// swap their rosters and merge them. Both lists only grow, and a revoked device stays revoked, so
+// that a revocation on any device reaches the whole group as its devices talk to each other.
+//
+// Holding the PSK is not enough to be a member. Each device on the roster is endorsed by a member,
+// either when invited by it, or approved on it after being turned away; each revocation is signed by
+// a member as well. Only the endorsements and revocations signed by a member of our own roster are
+// taken from a peer, so a device cannot enroll or revoke on its own. The exception is a device still
+// on its own, which takes the roster of a peer endorsing it, as that is how it joins the group;
+// and a new device, which takes in the first peer holding the PSK, for upgrading from before the roster.
+package roster
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Device is a member of the group
+type Device struct {
+	Name string            `json:"name"`
+	Key  ed25519.PublicKey `json:"key"`
+	// The member endorsing the device on the roster, or revoking it, and its signature over the key
+	By  ed25519.PublicKey `json:"by,omitempty"`
+	Sig []byte            `json:"sig,omitempty"`
+}
+
+const (
+	endorsement = "acp roster endorsement|"
+	revocation  = "acp roster revocation|"
+)
+
+// vouch signs for the device with key, on the endorsement or the revocation of it
+func vouch(d Device, key ed25519.PrivateKey, what string) Device {
+	d.By = key.Public().(ed25519.PublicKey)
+	d.Sig = ed25519.Sign(key, append([]byte(what), d.Key...))
+	return d
+}
+
+// vouched tells if the device carries a valid signature on the endorsement or the revocation of it
+func (d Device) vouched(what string) bool {
+	return len(d.By) == ed25519.PublicKeySize && ed25519.Verify(d.By, append([]byte(what), d.Key...), d.Sig)
+}
+
+// Fingerprint is a short form of the device key for display
+func (d Device) Fingerprint() string {
+	h := sha256.Sum256(d.Key)
+	return base64.RawURLEncoding.EncodeToString(h[:9])
+}
+
+// Roster lists the devices of the group
+type Roster struct {
+	Devices []Device          `json:"devices"`
+	Revoked []Device          `json:"revoked,omitempty"`
+	Signer  ed25519.PublicKey `json:"signer,omitempty"`
+	Sig     []byte            `json:"sig,omitempty"`
+	// Devices turned away for not being on the roster, to be approved; kept to this device
+	Pending []Device `json:"pending,omitempty"`
+	// Whether to take in the first device met with the PSK, as a device set up before the roster
+	// did with any; kept to this device, until a peer is on the roster
+	Seeding bool `json:"seeding,omitempty"`
+}
+
+const maxPending = 8
+
+func (r *Roster) find(key ed25519.PublicKey) int {
+	return slices.IndexFunc(r.Devices, func(d Device) bool { return bytes.Equal(d.Key, key) })
+}
+
+func (r *Roster) revoked(key ed25519.PublicKey) bool {
+	return slices.ContainsFunc(r.Revoked, func(d Device) bool { return bytes.Equal(d.Key, key) })
+}
+
+// add puts the device on the roster unless known or revoked, renaming it if the name is taken
+func (r *Roster) add(d Device) bool {
+	if r.find(d.Key) >= 0 || r.revoked(d.Key) {
+		return false
+	}
+	name := d.Name
+	for i := 2; slices.ContainsFunc(r.Devices, func(o Device) bool { return o.Name == d.Name }); i++ {
+		d.Name = fmt.Sprintf("%s-%d", name, i)
+	}
+	r.Devices = append(r.Devices, d)
+	return true
+}
+
+func (r *Roster) revoke(d Device) bool {
+	if r.revoked(d.Key) {
+		return false
+	}
+	r.Devices = slices.DeleteFunc(r.Devices, func(o Device) bool { return bytes.Equal(o.Key, d.Key) })
+	r.Revoked = append(r.Revoked, d)
+	return true
+}
+
+// merge takes in the devices and revocations from another roster, reporting whether anything changed.
+// Only those signed by a member are taken, over and over as more members are learned.
+func (r *Roster) merge(o *Roster) (changed bool) {
+	for more := true; more; changed = changed || more {
+		more = false
+		for _, d := range o.Revoked {
+			// Not from a revoker revoked by another, as it might be the one to be kept out
+			heeded := bytes.Equal(d.By, d.Key) || !o.revoked(d.By)
+			if heeded && r.find(d.By) >= 0 && d.vouched(revocation) {
+				more = r.revoke(d) || more
+			}
+		}
+		for _, d := range o.Devices {
+			if r.find(d.By) >= 0 && d.vouched(endorsement) {
+				more = r.add(d) || more
+			}
+		}
+	}
+	return
+}
+
+// endorses tells if the roster has the device on it, endorsed by a member
+func (r *Roster) endorses(key ed25519.PublicKey) bool {
+	i := r.find(key)
+	return i >= 0 && r.find(r.Devices[i].By) >= 0 && r.Devices[i].vouched(endorsement)
+}
+
+// hold remembers the device turned away, for it to be approved later
+func (r *Roster) hold(d Device) {
+	r.Pending = slices.DeleteFunc(r.Pending, func(o Device) bool { return bytes.Equal(o.Key, d.Key) })
+	r.Pending = append(r.Pending, Device{Name: d.Name, Key: d.Key})
+	if len(r.Pending) > maxPending {
+		r.Pending = r.Pending[len(r.Pending)-maxPending:]
+	}
+}
+
+func (r *Roster) signedBytes() []byte {
+	b, _ := json.Marshal(&Roster{Devices: r.Devices, Revoked: r.Revoked, Signer: r.Signer})
+	return b
+}
+
+func (r *Roster) sign(key ed25519.PrivateKey) {
+	r.Signer = key.Public().(ed25519.PublicKey)
+	r.Sig = ed25519.Sign(key, r.signedBytes())
+}
+
+// Verify checks that the roster is signed by its signer
+func (r *Roster) Verify() error {
+	if len(r.Signer) != ed25519.PublicKeySize || !ed25519.Verify(r.Signer, r.signedBytes(), r.Sig) {
+		return errors.New("invalid roster signature")
+	}
+	return nil
+}
+
+// Group is this device along with the roster, stored in a directory
+type Group struct {
+	dir  string
+	Self Device
+	key  ed25519.PrivateKey
+
+	mu     sync.Mutex
+	roster Roster
+}
+
+const (
+	deviceFilename = "device.json"
+	rosterFilename = "roster.json"
+)
+
+type deviceFile struct {
+	Name string             `json:"name"`
+	Key  ed25519.PrivateKey `json:"key"`
+}
+
+// Open loads the group from dir, generating a key for this device on the first run. A new device,
+// which might have been set up before the roster, seeds its roster with the first peer it meets.
+func Open(dir string) (*Group, error) {
+	g := &Group{dir: dir}
+	var dev deviceFile
+	err := readJSON(filepath.Join(dir, deviceFilename), &dev)
+	if errors.Is(err, os.ErrNotExist) {
+		dev.Name, _ = os.Hostname()
+		if dev.Name == "" {
+			dev.Name = "device"
+		}
+		_, dev.Key, _ = ed25519.GenerateKey(nil)
+		err = writeJSON(filepath.Join(dir, deviceFilename), &dev)
+		g.roster.Seeding = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(dev.Key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid device key in %s", filepath.Join(dir, deviceFilename))
+	}
+	g.key = dev.Key
+	g.Self = Device{Name: dev.Name, Key: dev.Key.Public().(ed25519.PublicKey)}
+
+	err = readJSON(filepath.Join(dir, rosterFilename), &g.roster)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	changed := g.roster.add(vouch(g.Self, g.key, endorsement))
+	// Those listed before the endorsements were signed for are taken as they are
+	for i, d := range g.roster.Devices {
+		if d.Sig == nil {
+			g.roster.Devices[i], changed = vouch(d, g.key, endorsement), true
+		}
+	}
+	for i, d := range g.roster.Revoked {
+		if d.Sig == nil {
+			g.roster.Revoked[i], changed = vouch(d, g.key, revocation), true
+		}
+	}
+	if changed {
+		g.roster.sign(g.key)
+		if err = g.save(); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// Roster returns a copy of the roster
+func (g *Group) Roster() Roster {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	r := g.roster
+	r.Devices, r.Revoked, r.Pending = slices.Clone(r.Devices), slices.Clone(r.Revoked), slices.Clone(r.Pending)
+	return r
+}
+
+// Approve endorses the named device turned away before, letting it into the group
+func (g *Group) Approve(name string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	i := slices.IndexFunc(g.roster.Pending, func(d Device) bool { return d.Name == name })
+	if i < 0 {
+		return fmt.Errorf("no device named %q waiting for approval", name)
+	}
+	d := g.roster.Pending[i]
+	g.roster.Pending = slices.Delete(g.roster.Pending, i, i+1)
+	if !g.roster.add(vouch(d, g.key, endorsement)) {
+		return fmt.Errorf("device %s (%s) has been revoked", d.Name, d.Fingerprint())
+	}
+	g.roster.sign(g.key)
+	return g.save()
+}
+
+// Revoke removes the named device from the group for good
+func (g *Group) Revoke(name string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	i := slices.IndexFunc(g.roster.Devices, func(d Device) bool { return d.Name == name })
+	if i < 0 {
+		return fmt.Errorf("no device named %q in the roster", name)
+	}
+	d := g.roster.Devices[i]
+	if bytes.Equal(d.Key, g.Self.Key) {
+		return errors.New("cannot revoke this device itself")
+	}
+	g.roster.revoke(vouch(d, g.key, revocation))
+	g.roster.sign(g.key)
+	return g.save()
+}
+
+// Save stores the roster, as taken by Join
+func (g *Group) Save() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.save()
+}
+
+func (g *Group) save() error {
+	return writeJSON(filepath.Join(g.dir, rosterFilename), &g.roster)
+}
+
+func readJSON(filename string, v any) error {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("error parsing %s: %w", filename, err)
+	}
+	return nil
+}
+
+func writeJSON(filename string, v any) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0o700); err != nil {
+		return fmt.Errorf("error creating directory for %s: %w", filename, err)
+	}
+	// Written aside and renamed over, as another acp process might be reading it
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", filename, err)
+	}
+	defer os.Remove(f.Name())
+	b, _ := json.MarshalIndent(v, "", "  ")
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", filename, err)
+	}
+	return nil
+}
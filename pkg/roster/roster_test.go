@@ -0,0 +1,249 @@
+package roster
+
+import (
+	"strings"
+	"testing"
+)
+
+func openGroup(t *testing.T, dir string) *Group {
+	g, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	g := openGroup(t, dir)
+	if r := g.Roster(); len(r.Devices) != 1 || r.Devices[0].Name != g.Self.Name || r.Verify() != nil {
+		t.Fatalf("unexpected roster %+v", r)
+	}
+	again := openGroup(t, dir)
+	if !again.Self.Key.Equal(g.Self.Key) || len(again.Roster().Devices) != 1 {
+		t.Errorf("device not kept across runs")
+	}
+	if err := g.Revoke(g.Self.Name); err == nil {
+		t.Errorf("revoked itself")
+	}
+	if err := g.Revoke("nonexistent"); err == nil {
+		t.Errorf("revoked an unknown device")
+	}
+}
+
+// transfer has two devices transfer, x presenting first
+func transfer(x, y *Group) error {
+	binding := []byte(x.Self.Fingerprint() + y.Self.Fingerprint())
+	if _, err := y.Accept(binding, x.Hello(binding)); err != nil {
+		return err
+	}
+	_, err := x.Accept(binding, y.Hello(binding))
+	return err
+}
+
+// invite has x enroll y, y presenting first
+func invite(x, y *Group) error {
+	binding := []byte(x.Self.Fingerprint() + y.Self.Fingerprint())
+	if _, err := x.Enroll(binding, y.Hello(binding)); err != nil {
+		return err
+	}
+	if _, err := y.Join(binding, x.Hello(binding)); err != nil {
+		return err
+	}
+	return y.Save()
+}
+
+func TestJoin(t *testing.T) {
+	a, b, c := openGroup(t, t.TempDir()), openGroup(t, t.TempDir()), openGroup(t, t.TempDir())
+	if err := invite(b, c); err != nil {
+		t.Fatalf("enrollment failed: %v", err)
+	}
+
+	// c leaves the group of b for that of a, which is only stored once saved
+	binding := []byte("session")
+	if _, err := c.Join(binding, a.Hello(binding)); err == nil {
+		t.Errorf("joined without an endorsement")
+	}
+	if _, err := a.Enroll(binding, c.Hello(binding)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Join(binding, a.Hello(binding)); err != nil {
+		t.Fatal(err)
+	}
+	if r := openGroup(t, c.dir).Roster(); r.find(b.Self.Key) < 0 || r.find(a.Self.Key) >= 0 {
+		t.Errorf("roster replaced before saved: %+v", r.Devices)
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if r := openGroup(t, c.dir).Roster(); r.find(b.Self.Key) >= 0 || r.find(a.Self.Key) < 0 {
+		t.Errorf("roster not replaced: %+v", r.Devices)
+	}
+	if err := transfer(c, a); err != nil {
+		t.Errorf("transfer failed after joining: %v", err)
+	}
+}
+
+func TestSeeding(t *testing.T) {
+	// Devices set up before the roster, upgraded together
+	a, b, c := openGroup(t, t.TempDir()), openGroup(t, t.TempDir()), openGroup(t, t.TempDir())
+	if h := a.Hello(nil); !a.Roster().Seeding || h.Roster.Seeding {
+		t.Fatalf("new device not seeding, or telling it to the peer")
+	}
+	if err := transfer(a, b); err != nil {
+		t.Fatalf("new devices rejected: %v", err)
+	}
+	if len(a.Roster().Devices) != 2 || len(b.Roster().Devices) != 2 || b.Roster().Seeding {
+		t.Fatalf("roster not seeded: %+v, %+v", a.Roster(), b.Roster())
+	}
+	if openGroup(t, a.dir).Roster().Seeding {
+		t.Errorf("seeding not ended for good")
+	}
+
+	// Only the first peer is taken, and the others are approved
+	if err := transfer(c, a); err == nil || !strings.Contains(err.Error(), "not on the roster") {
+		t.Fatalf("device accepted after seeding: %v", err)
+	}
+	if err := a.Approve(a.Roster().Pending[0].Name); err != nil {
+		t.Fatal(err)
+	}
+	if err := transfer(c, a); err != nil {
+		t.Fatalf("approved device refused: %v", err)
+	}
+	if err := transfer(c, b); err != nil {
+		t.Errorf("approved device not propagated: %v", err)
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	a, b, c := openGroup(t, t.TempDir()), openGroup(t, t.TempDir()), openGroup(t, t.TempDir())
+	for _, p := range [][2]*Group{{a, b}, {b, c}} {
+		if err := invite(p[0], p[1]); err != nil {
+			t.Fatalf("enrollment failed: %v", err)
+		}
+	}
+	if err := transfer(a, b); err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+	r := a.Roster()
+	if len(r.Devices) != 3 || r.Devices[1].Name == r.Devices[0].Name || r.Devices[2].Name == r.Devices[0].Name {
+		t.Fatalf("devices not propagated or named apart: %+v", r.Devices)
+	}
+
+	// a revokes c, which reaches b on their next transfer, and then c is turned away by b
+	name := r.Devices[r.find(c.Self.Key)].Name
+	if err := a.Revoke(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := transfer(a, c); err == nil {
+		t.Errorf("revoked device accepted")
+	}
+	if err := transfer(a, b); err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+	if err := transfer(c, b); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("revocation not propagated: %v", err)
+	}
+	if err := transfer(b, c); err == nil {
+		t.Errorf("revoked device accepted")
+	}
+
+	// Once revoked, a device is not enrolled again by the roster of another
+	stale := c.Roster()
+	stale.sign(c.key)
+	b.roster.merge(&stale)
+	if b.roster.find(c.Self.Key) >= 0 {
+		t.Errorf("revoked device enrolled again")
+	}
+
+	// Nor does it come back with a new key
+	fresh := openGroup(t, t.TempDir())
+	if err := transfer(fresh, b); err == nil || !strings.Contains(err.Error(), "not on the roster") {
+		t.Errorf("unknown device accepted: %v", err)
+	}
+	if len(b.Roster().Devices) != 2 {
+		t.Errorf("unknown device enrolled: %+v", b.Roster().Devices)
+	}
+}
+
+func TestApprove(t *testing.T) {
+	a, b, c := openGroup(t, t.TempDir()), openGroup(t, t.TempDir()), openGroup(t, t.TempDir())
+	if err := invite(a, b); err != nil {
+		t.Fatalf("enrollment failed: %v", err)
+	}
+
+	// c holds the PSK but is on no roster, until approved on b, and then reaches a through b
+	if err := transfer(c, b); err == nil {
+		t.Fatalf("unknown device accepted")
+	}
+	pending := b.Roster().Pending
+	if len(pending) != 1 || !pending[0].Key.Equal(c.Self.Key) {
+		t.Fatalf("unknown device not held for approval: %+v", pending)
+	}
+	if err := b.Approve(pending[0].Name); err != nil {
+		t.Fatal(err)
+	}
+	if err := transfer(c, b); err != nil {
+		t.Fatalf("approved device refused: %v", err)
+	}
+	if len(c.Roster().Devices) != 3 {
+		t.Errorf("roster not taken by the approved device: %+v", c.Roster().Devices)
+	}
+	if err := transfer(b, a); err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+	if err := transfer(c, a); err != nil {
+		t.Errorf("approved device not propagated: %v", err)
+	}
+}
+
+func TestUnsignedChanges(t *testing.T) {
+	a, b, mallory := openGroup(t, t.TempDir()), openGroup(t, t.TempDir()), openGroup(t, t.TempDir())
+	if err := invite(a, b); err != nil {
+		t.Fatalf("enrollment failed: %v", err)
+	}
+
+	// An outsider enrolling itself, and revoking b, on its own roster
+	r := mallory.Roster()
+	r.revoke(vouch(b.Self, mallory.key, revocation))
+	r.sign(mallory.key)
+	if a.roster.merge(&r) || a.roster.find(b.Self.Key) < 0 || a.roster.find(mallory.Self.Key) >= 0 {
+		t.Errorf("changes not signed by a member taken: %+v", a.Roster())
+	}
+	// A member enrolling another without signing for it
+	r = b.Roster()
+	r.add(mallory.Self)
+	r.sign(b.key)
+	if a.roster.merge(&r) {
+		t.Errorf("unendorsed device taken: %+v", a.Roster())
+	}
+}
+
+func TestForgedHello(t *testing.T) {
+	a, b, mallory := openGroup(t, t.TempDir()), openGroup(t, t.TempDir()), openGroup(t, t.TempDir())
+	binding := []byte("session")
+
+	replayed := b.Hello([]byte("another session"))
+	if _, err := a.Accept(binding, replayed); err == nil {
+		t.Errorf("replayed hello accepted")
+	}
+
+	// A roster not signed by the peer presenting it
+	forged := mallory.Hello(binding)
+	r := a.Roster()
+	r.revoke(b.Self)
+	r.sign(b.key)
+	forged.Roster = &r
+	if _, err := a.Accept(binding, forged); err == nil {
+		t.Errorf("roster from another device accepted")
+	}
+
+	tampered := b.Hello(binding)
+	tampered.Roster.Devices = append(tampered.Roster.Devices, mallory.Self)
+	if _, err := a.Accept(binding, tampered); err == nil {
+		t.Errorf("tampered roster accepted")
+	}
+	if len(a.Roster().Devices) != 1 {
+		t.Errorf("roster changed by rejected hellos: %+v", a.Roster().Devices)
+	}
+}
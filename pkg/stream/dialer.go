@@ -22,11 +22,15 @@ import (
 //
 // 2. Specify information exchange in pnet.SelfInfo and pnet.PeerInfo
 // 3. (optional) Provide configurable options in config.Config
+// 4. (optional) Implement io.Closer to release resources held since Init (e.g. port mappings),
+// which is called when acp exits, even if the Dialer is not used for the transfer
 type Dialer interface {
 	// Initialize Dialer from config and environment, while checking availability.
-	// Return ErrNotAvailable if Dialer is not supported
+	// Return ErrNotAvailable if Dialer is not supported. Slow probing (e.g. STUN) should be
+	// left running in the background, to be awaited in SetInfo.
 	Init(conf config.Config) error
-	// Populate the info struct to be sent to rendezvous service for information exchange
+	// Populate the info struct to be sent to rendezvous service for information exchange,
+	// called once all dialers of the strategy are initialized
 	SetInfo(info *pnet.SelfInfo)
 	// Base on the info received, establish a stream as the sender
 	IntoSender(ctx context.Context, info pnet.PeerInfo) (io.WriteCloser, error)
@@ -50,6 +54,9 @@ func GetDialer(name string) (Dialer, error) {
 
 var ErrNotAvailable = errors.New("this dialer is not available")
 
+// Hole punching needs direct connections, which are ruled out when going through a proxy
+var errProxied = fmt.Errorf("hole punching is impossible through a proxy: %w", ErrNotAvailable)
+
 var defaultLogger pnet.Logger
 
 func SetLogger(l pnet.Logger) {
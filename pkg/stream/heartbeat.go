@@ -0,0 +1,422 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/contextualist/acp/pkg/pnet"
+	"github.com/contextualist/acp/pkg/roster"
+)
+
+// A heartbeat layer frames the data from sender to receiver, so that both ends
+// can tell an idle-but-alive peer from a dead one.
+//
+//	sender -> receiver: [type (1 byte) | len (uint32, BE) | payload]...
+//	receiver -> sender: control bytes
+//
+// The sender emits a ping frame whenever it has nothing to write for a while
+// (e.g. walking a large directory), and the receiver keeps sending ping bytes
+// back regardless of how fast it consumes the data. Each end aborts if it hears
+// nothing from the other within the idle timeout.
+//
+// The sender may start with an offer frame describing the transfer, which the receiver answers with
+// an accept or a reject byte before the data follows.
+//
+// The layer is only set up if the peer announces it in the exchanged info (PeerInfo.Heartbeat);
+// otherwise the stream is left unframed, as older versions of acp expect.
+
+const (
+	frameData byte = iota
+	framePing
+	frameEnd
+	frameOffer
+)
+
+const (
+	ctrlPing byte = iota
+	ctrlAck
+	ctrlAccept
+	ctrlReject
+)
+
+const (
+	frameHeaderLen = 5
+	// Upper bound of the time spent on consuming the trailing data when closing early
+	drainTimeout = 1 * time.Second
+	maxOfferLen  = 1 << 16
+)
+
+// ErrPeerUnresponsive is returned when nothing is heard from the peer for the idle timeout
+var ErrPeerUnresponsive = errors.New("peer unresponsive")
+
+// ErrRejected is returned to the sender when the receiver rejects the offer
+var ErrRejected = errors.New("the receiver rejected the transfer")
+
+// An Offerer is a sending stream that can describe the transfer to the receiver ahead of the data
+type Offerer interface {
+	// Offer sends the description, and waits for the receiver to accept it
+	Offer(desc []byte) error
+}
+
+// An OfferReceiver is a receiving stream on which the sender might describe the transfer ahead of the data
+type OfferReceiver interface {
+	// Offered reads the description, along with the device of the peer if authenticated by its device key
+	Offered() (desc []byte, peer *roster.Device, err error)
+	// Answer accepts or rejects the offer
+	Answer(accept bool) error
+}
+
+func errUnresponsive(timeout time.Duration) error {
+	return fmt.Errorf("%w for %ds", ErrPeerUnresponsive, int(timeout.Seconds()))
+}
+
+// senderStream sets up the sending end of a stream on conn, with a heartbeat layer if the peer speaks it
+func senderStream(conn net.Conn, info *pnet.PeerInfo, timeout time.Duration) io.WriteCloser {
+	if !info.Heartbeat {
+		return conn
+	}
+	return withHeartbeatSender(conn, timeout)
+}
+
+// receiverStream sets up the receiving end of a stream on conn, with a heartbeat layer if the peer speaks it
+func receiverStream(conn net.Conn, info *pnet.PeerInfo, timeout time.Duration) io.ReadCloser {
+	if !info.Heartbeat {
+		return conn
+	}
+	return withHeartbeatReceiver(conn, timeout)
+}
+
+type heartbeatSender struct {
+	conn     net.Conn
+	timeout  time.Duration
+	mu       sync.Mutex // guards writes to conn
+	lastSeen atomic.Int64
+	lastSent atomic.Int64
+	chAck    chan struct{}
+	chAnswer chan bool
+	chQuit   chan struct{}
+	failOnce sync.Once
+	err      error
+}
+
+// withHeartbeatSender wraps conn as the sending end of a heartbeat layer
+func withHeartbeatSender(conn net.Conn, timeout time.Duration) io.WriteCloser {
+	s := &heartbeatSender{
+		conn:     conn,
+		timeout:  timeout,
+		chAck:    make(chan struct{}),
+		chAnswer: make(chan bool, 1),
+		chQuit:   make(chan struct{}),
+	}
+	now := time.Now().UnixNano()
+	s.lastSeen.Store(now)
+	s.lastSent.Store(now)
+	go s.readControl()
+	go s.watch()
+	return s
+}
+
+func (s *heartbeatSender) Write(p []byte) (n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = s.writeFrame(frameData, p); err != nil {
+		return 0, s.wrapErr(err)
+	}
+	return len(p), nil
+}
+
+func (s *heartbeatSender) Offer(desc []byte) error {
+	s.mu.Lock()
+	err := s.writeFrame(frameOffer, desc)
+	s.mu.Unlock()
+	if err != nil {
+		return s.wrapErr(err)
+	}
+	select {
+	case ok := <-s.chAnswer:
+		if !ok {
+			s.fail(ErrRejected)
+			return ErrRejected
+		}
+		return nil
+	case <-s.chQuit:
+		return s.wrapErr(net.ErrClosed)
+	}
+}
+
+// writeFrame needs to be called with s.mu held
+func (s *heartbeatSender) writeFrame(typ byte, p []byte) error {
+	var hdr [frameHeaderLen]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(p)))
+	if _, err := s.conn.Write(hdr[:]); err != nil {
+		return err
+	}
+	if len(p) > 0 {
+		if _, err := s.conn.Write(p); err != nil {
+			return err
+		}
+	}
+	s.lastSent.Store(time.Now().UnixNano())
+	return nil
+}
+
+// Close signals the end of stream, and waits for the receiver to acknowledge
+// before tearing down the connection
+func (s *heartbeatSender) Close() (err error) {
+	s.mu.Lock()
+	err = s.writeFrame(frameEnd, nil)
+	s.mu.Unlock()
+	if err == nil {
+		select {
+		case <-s.chAck:
+		case <-s.chQuit:
+			err = s.err
+		}
+	}
+	s.fail(nil)
+	if cerr := s.conn.Close(); err == nil && !errors.Is(cerr, net.ErrClosed) {
+		err = cerr
+	}
+	return s.wrapErr(err)
+}
+
+func (s *heartbeatSender) readControl() {
+	var b [1]byte
+	for {
+		if _, err := s.conn.Read(b[:]); err != nil {
+			s.fail(fmt.Errorf("connection to peer lost: %w", err))
+			return
+		}
+		s.lastSeen.Store(time.Now().UnixNano())
+		switch b[0] {
+		case ctrlAck:
+			close(s.chAck)
+			return
+		case ctrlAccept, ctrlReject:
+			select {
+			case s.chAnswer <- b[0] == ctrlAccept:
+			default:
+			}
+		}
+	}
+}
+
+func (s *heartbeatSender) watch() {
+	ticker := time.NewTicker(heartbeatInterval(s.timeout))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.chQuit:
+			return
+		}
+		now := time.Now()
+		if now.Sub(time.Unix(0, s.lastSeen.Load())) > s.timeout {
+			s.fail(errUnresponsive(s.timeout))
+			return
+		}
+		if now.Sub(time.Unix(0, s.lastSent.Load())) >= heartbeatInterval(s.timeout) && s.mu.TryLock() {
+			_ = s.writeFrame(framePing, nil)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// fail records the first error (if any) and shuts down the background routines.
+// Closing the conn unblocks any pending Write.
+func (s *heartbeatSender) fail(err error) {
+	s.failOnce.Do(func() {
+		s.err = err
+		close(s.chQuit)
+		if err != nil {
+			_ = s.conn.Close()
+		}
+	})
+}
+
+// wrapErr prefers the recorded failure reason over the error it caused
+func (s *heartbeatSender) wrapErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	select {
+	case <-s.chQuit:
+		if s.err != nil {
+			return s.err
+		}
+	default:
+	}
+	return err
+}
+
+type heartbeatReceiver struct {
+	conn      net.Conn
+	timeout   time.Duration
+	mu        sync.Mutex // guards writes to conn
+	remaining uint32
+	eof       bool
+	// If set, overrides the idle timeout when reading
+	drainUntil time.Time
+	chQuit     chan struct{}
+	quitOnce   sync.Once
+}
+
+// withHeartbeatReceiver wraps conn as the receiving end of a heartbeat layer
+func withHeartbeatReceiver(conn net.Conn, timeout time.Duration) io.ReadCloser {
+	r := &heartbeatReceiver{
+		conn:    conn,
+		timeout: timeout,
+		chQuit:  make(chan struct{}),
+	}
+	go r.ping()
+	return r
+}
+
+func (r *heartbeatReceiver) Read(p []byte) (n int, err error) {
+	for r.remaining == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		var hdr [frameHeaderLen]byte
+		if err = r.readFull(hdr[:]); err != nil {
+			return 0, err
+		}
+		switch hdr[0] {
+		case frameData:
+			r.remaining = binary.BigEndian.Uint32(hdr[1:])
+		case framePing:
+		case frameOffer:
+			return 0, errors.New("unexpected offer from the sender")
+		case frameEnd:
+			r.eof = true
+			r.stopPing()
+			r.mu.Lock()
+			_, err = r.conn.Write([]byte{ctrlAck})
+			r.mu.Unlock()
+			if err != nil {
+				return 0, fmt.Errorf("failed to acknowledge end of stream: %w", err)
+			}
+		default:
+			return 0, fmt.Errorf("unknown frame type %d", hdr[0])
+		}
+	}
+	if uint32(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	if err = r.conn.SetReadDeadline(r.deadline()); err != nil {
+		return
+	}
+	n, err = r.conn.Read(p)
+	r.remaining -= uint32(n)
+	return n, r.wrapErr(err)
+}
+
+func (r *heartbeatReceiver) Offered() (desc []byte, peer *roster.Device, err error) {
+	if sc, ok := r.conn.(*sessionConn); ok {
+		peer = sc.peer
+	}
+	var hdr [frameHeaderLen]byte
+	for {
+		if err = r.readFull(hdr[:]); err != nil {
+			return nil, nil, err
+		}
+		if hdr[0] != framePing {
+			break
+		}
+	}
+	if hdr[0] != frameOffer {
+		return nil, nil, errors.New("no offer from the sender")
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxOfferLen {
+		return nil, nil, fmt.Errorf("offer too large (%d bytes)", n)
+	}
+	desc = make([]byte, n)
+	if err = r.readFull(desc); err != nil {
+		return nil, nil, err
+	}
+	return desc, peer, nil
+}
+
+func (r *heartbeatReceiver) Answer(accept bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := r.conn.Write([]byte{tern(accept, ctrlAccept, ctrlReject)})
+	return err
+}
+
+func (r *heartbeatReceiver) readFull(p []byte) error {
+	if err := r.conn.SetReadDeadline(r.deadline()); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(r.conn, p)
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF // the sender always ends with frameEnd
+	}
+	return r.wrapErr(err)
+}
+
+func (r *heartbeatReceiver) deadline() time.Time {
+	if !r.drainUntil.IsZero() {
+		return r.drainUntil
+	}
+	return time.Now().Add(r.timeout)
+}
+
+func (r *heartbeatReceiver) wrapErr(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return errUnresponsive(r.timeout)
+	}
+	return err
+}
+
+func (r *heartbeatReceiver) ping() {
+	ticker := time.NewTicker(heartbeatInterval(r.timeout))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.chQuit:
+			return
+		}
+		r.mu.Lock()
+		select {
+		case <-r.chQuit: // do not ping after the ack
+			r.mu.Unlock()
+			return
+		default:
+		}
+		_, err := r.conn.Write([]byte{ctrlPing})
+		r.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *heartbeatReceiver) stopPing() {
+	r.quitOnce.Do(func() { close(r.chQuit) })
+}
+
+// Close consumes what is left of the stream (e.g. archive padding), so that
+// the end of stream is acknowledged to the sender
+func (r *heartbeatReceiver) Close() error {
+	if !r.eof {
+		r.drainUntil = time.Now().Add(drainTimeout)
+		_, _ = io.Copy(io.Discard, r)
+	}
+	r.stopPing()
+	return r.conn.Close()
+}
+
+func heartbeatInterval(timeout time.Duration) time.Duration {
+	return timeout / 4
+}
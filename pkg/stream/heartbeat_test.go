@@ -0,0 +1,138 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/contextualist/acp/pkg/pnet"
+)
+
+func TestHeartbeat(t *testing.T) {
+	ca, cb := net.Pipe()
+	timeout := 200 * time.Millisecond
+	s := withHeartbeatSender(ca, timeout)
+	r := withHeartbeatReceiver(cb, timeout)
+
+	data := bytes.Repeat([]byte("acp"), 10000)
+	chErr := make(chan error, 1)
+	go func() {
+		if _, err := s.Write(data[:100]); err != nil {
+			chErr <- err
+			return
+		}
+		time.Sleep(2 * timeout) // idle, but alive
+		if _, err := s.Write(data[100:]); err != nil {
+			chErr <- err
+			return
+		}
+		chErr <- s.Close()
+	}()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("receiver: %v", err)
+	}
+	if err = <-chErr; err != nil {
+		t.Fatalf("sender: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("data mismatch: sent %d bytes, received %d bytes", len(data), len(got))
+	}
+	_ = r.Close()
+}
+
+func TestHeartbeatUnresponsive(t *testing.T) {
+	timeout := 200 * time.Millisecond
+
+	ca, cb := net.Pipe()
+	s := withHeartbeatSender(ca, timeout)
+	go func() { _, _ = io.Copy(io.Discard, cb) }() // a peer that reads but never pings
+	start := time.Now()
+	var err error
+	for err == nil && time.Since(start) < 10*timeout {
+		_, err = s.Write([]byte("acp"))
+		time.Sleep(timeout / 10)
+	}
+	if !errors.Is(err, ErrPeerUnresponsive) {
+		t.Fatalf("sender did not detect an unresponsive peer: %v", err)
+	}
+
+	ca, cb = net.Pipe()
+	r := withHeartbeatReceiver(cb, timeout)
+	go func() { _, _ = io.Copy(io.Discard, ca) }() // a peer that never sends
+	if _, err = r.Read(make([]byte, 10)); !errors.Is(err, ErrPeerUnresponsive) {
+		t.Fatalf("receiver did not detect an unresponsive peer: %v", err)
+	}
+	_ = r.Close()
+}
+
+func TestHeartbeatOffer(t *testing.T) {
+	timeout := 200 * time.Millisecond
+	for _, accept := range []bool{true, false} {
+		ca, cb := net.Pipe()
+		s := withHeartbeatSender(ca, timeout)
+		r := withHeartbeatReceiver(cb, timeout)
+		chErr := make(chan error, 1)
+		go func() {
+			if err := s.(Offerer).Offer([]byte("manifest")); err != nil {
+				_ = s.Close()
+				chErr <- err
+				return
+			}
+			_, _ = s.Write([]byte("acp"))
+			chErr <- s.Close()
+		}()
+
+		desc, _, err := r.(OfferReceiver).Offered()
+		if err != nil || string(desc) != "manifest" {
+			t.Fatalf("offer not received: %q, %v", desc, err)
+		}
+		time.Sleep(2 * timeout) // deciding, while both ends stay alive
+		if err = r.(OfferReceiver).Answer(accept); err != nil {
+			t.Fatalf("failed to answer: %v", err)
+		}
+		if accept {
+			got, err := io.ReadAll(r)
+			if err != nil || string(got) != "acp" {
+				t.Errorf("data not received after accepting: %q, %v", got, err)
+			}
+			if err = <-chErr; err != nil {
+				t.Errorf("sender: %v", err)
+			}
+		} else if err = <-chErr; !errors.Is(err, ErrRejected) {
+			t.Errorf("rejection not reported to the sender: %v", err)
+		}
+		_ = r.Close()
+	}
+}
+
+func TestHeartbeatLegacyPeer(t *testing.T) {
+	ca, cb := net.Pipe()
+	timeout := 200 * time.Millisecond
+	// A peer not announcing heartbeats gets the stream unframed
+	s := senderStream(ca, &pnet.PeerInfo{}, timeout)
+	if _, ok := s.(Offerer); ok {
+		t.Fatal("sender to a legacy peer should not be framed")
+	}
+	go func() {
+		_, _ = s.Write([]byte("acp"))
+		_ = s.Close()
+	}()
+	got, err := io.ReadAll(cb)
+	if err != nil {
+		t.Fatalf("receiver: %v", err)
+	}
+	if string(got) != "acp" {
+		t.Fatalf("got %q from the unframed stream", got)
+	}
+
+	r := receiverStream(cb, &pnet.PeerInfo{Heartbeat: true}, timeout)
+	defer func() { _ = r.Close() }()
+	if _, ok := r.(OfferReceiver); !ok {
+		t.Fatal("receiver from a peer announcing heartbeats should be framed")
+	}
+}
@@ -1,13 +1,479 @@
 package stream
 
 import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"slices"
+	"time"
 
 	aead "github.com/shadowsocks/go-shadowsocks2/shadowaead"
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/contextualist/acp/pkg/config"
+	"github.com/contextualist/acp/pkg/pnet"
+	"github.com/contextualist/acp/pkg/roster"
+)
+
+// An encrypted layer starts with a Noise NNpsk0 handshake (https://noiseprotocol.org/noise.html#handshake-patterns),
+// where the ephemeral X25519 keys of both ends are mixed with the PSK:
+//
+//	initiator -> responder: [magic | version | e (32 bytes) | tag (16 bytes)]
+//	responder -> initiator: [magic | version | e (32 bytes) | tag (16 bytes)]
+//
+// The handshake authenticates both ends as holders of the PSK, and derives a fresh key for each
+// direction, so that a leaked PSK does not expose recorded transfers. The stream is then framed
+// as in Shadowsocks AEAD, with a key used once per session in place of the salt.
+//
+// Each end then presents its device key, signing the handshake hash, along with its roster of the
+// group (see package roster) in a frame of [length (uint32) | JSON]. The responder answers with a
+// refusal if the initiator is not on the roster. When enrolling a device, the joining one presents first.
+// Then, in the same kind of frame, each end hands over the new PSK if in a rotation, or null.
+//
+// Over a transport that is encrypted already (i.e., Tailscale), the stream may be left in the clear
+// after the handshake and the hellos, keeping only the authentication.
+//
+// Version 1 used the PSK directly as the Shadowsocks master key, without a handshake. It starts
+// right away with a random salt, which is told apart from the magic. Version 2 had no device hello,
+// version 3 no offer ahead of the stream in the heartbeat layer, and version 4 handed over the rotation
+// in the connection info instead.
+
+const (
+	handshakeMagic   = "acp\x00"
+	handshakeVersion = 5
+	handshakeHeader  = len(handshakeMagic) + 1 // with the version
+	handshakeTimeout = 10 * time.Second
+
+	noiseProtocol = "Noise_NNpsk0_25519_ChaChaPoly_SHA256"
+	noiseKeyLen   = 32
+
+	maxFrameLen = 1 << 16
 )
 
-func encrypted(conn net.Conn, psk []byte) (net.Conn, error) {
-	cipher, err := aead.Chacha20Poly1305(psk)
-	conn = aead.NewConn(conn, cipher)
-	return conn, err
+// ErrHandshake is returned when the peer fails to authenticate or speaks another protocol
+var ErrHandshake = errors.New("handshake failed")
+
+// encrypted authenticates the peer over conn and secures the stream. The sender initiates.
+func encrypted(conn net.Conn, psks [][]byte, initiator bool) (net.Conn, error) {
+	return startSession(conn, psks, initiator, true)
+}
+
+// authenticated is encrypted, except that the stream is left in the clear
+func authenticated(conn net.Conn, psks [][]byte, initiator bool) (net.Conn, error) {
+	return startSession(conn, psks, initiator, false)
+}
+
+func startSession(conn net.Conn, psks [][]byte, initiator, encrypt bool) (net.Conn, error) {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	sconn, err := newSession(conn, psks, initiator, encrypt)
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return sconn, nil
+}
+
+func newSession(conn net.Conn, psks [][]byte, initiator, encrypt bool) (net.Conn, error) {
+	tx, rx, binding, err := handshake(conn, psks, initiator)
+	if err != nil {
+		return nil, err
+	}
+	sconn := &sessionConn{Conn: conn, r: conn, w: conn}
+	if encrypt {
+		txAEAD, err := chacha20poly1305.New(tx)
+		if err != nil {
+			return nil, err
+		}
+		rxAEAD, err := chacha20poly1305.New(rx)
+		if err != nil {
+			return nil, err
+		}
+		sconn.r, sconn.w = aead.NewReader(conn, rxAEAD), aead.NewWriter(conn, txAEAD)
+	}
+	if sconn.peer, err = greet(sconn, defaultGroup, defaultEnrollment, binding, initiator); err != nil {
+		return nil, err
+	}
+	if defaultGroup != nil && defaultEnrollment == notEnrolling {
+		if err = handOver(sconn, defaultRotation, defaultPickUp, initiator); err != nil {
+			return nil, err
+		}
+	}
+	return sconn, nil
+}
+
+type sessionConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+	// The device of the peer, if authenticated by its device key
+	peer *roster.Device
+}
+
+func (c *sessionConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *sessionConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+// keyring holds the PSKs of this device: the current one, and the previous one during the grace
+// period of a rotation. While some devices might still be on the previous PSK, the rendezvous and
+// the handshake go on with it, and the new one is handed over by those who have it (see handOver).
+type keyring struct {
+	psk, prev []byte
+}
+
+func newKeyring(conf config.Config) (k keyring, err error) {
+	k.psk, k.prev, err = conf.Keys()
+	return
+}
+
+// channel is the PSK all devices have, for meeting the peer,
+// or the session key if sharing with someone outside the group
+func (k keyring) channel(info *pnet.PeerInfo) []byte {
+	if info.SessionKey != nil {
+		return info.SessionKey
+	}
+	if k.prev != nil {
+		return k.prev
+	}
+	return k.psk
+}
+
+// session returns the PSKs for the handshake with the peer. The initiator goes with the one
+// all devices have, and the responder takes any. Sharing with a code uses the session key alone.
+func (k keyring) session(info *pnet.PeerInfo, initiator bool) [][]byte {
+	if info.SessionKey != nil {
+		return [][]byte{info.SessionKey}
+	}
+	if initiator {
+		return [][]byte{k.channel(info)}
+	}
+	psks := [][]byte{k.psk}
+	if k.prev != nil {
+		psks = append(psks, k.prev)
+	}
+	return psks
+}
+
+// KeyRotation hands a new PSK to the devices yet to pick it up, during the grace period of the previous one
+type KeyRotation struct {
+	PSK   []byte `json:"psk"`
+	Until int64  `json:"until"` // end of the grace period, in Unix time
+}
+
+var (
+	defaultRotation *KeyRotation
+	defaultPickUp   func(r *KeyRotation)
+)
+
+// SetRotation has the new PSK handed over to the peers of the group, and the one handed over by a peer
+// passed to pickUp. Either way, only once the peer is authenticated as a device on the roster.
+func SetRotation(r *KeyRotation, pickUp func(r *KeyRotation)) {
+	defaultRotation, defaultPickUp = r, pickUp
+}
+
+// handOver swaps the rotations of both ends, if any, after the hellos
+func handOver(conn net.Conn, r *KeyRotation, pickUp func(r *KeyRotation), initiator bool) error {
+	if initiator {
+		if err := writeFrame(conn, r, "key rotation"); err != nil {
+			return err
+		}
+	}
+	peer, err := readFrame[KeyRotation](conn, "key rotation")
+	if err != nil {
+		return err
+	}
+	if !initiator {
+		if err = writeFrame(conn, r, "key rotation"); err != nil {
+			return err
+		}
+	}
+	if peer.PSK != nil && pickUp != nil {
+		pickUp(peer)
+	}
+	return nil
+}
+
+var (
+	defaultGroup      *roster.Group
+	defaultEnrollment enrollment
+)
+
+// enrollment is the part this device plays in enrolling a new device, if it is what the session is for
+type enrollment int
+
+const (
+	notEnrolling enrollment = iota
+	inviting
+	joining
+)
+
+// SetGroup has the peers authenticated by their device keys against the roster of the group.
+// Without a group, this device presents no key and takes any peer holding the PSK.
+func SetGroup(g *roster.Group) {
+	defaultGroup, defaultEnrollment = g, notEnrolling
+}
+
+// SetEnrollment is SetGroup for enrolling a new device: the inviting one endorses the peer,
+// and the joining one takes the roster endorsing it in return (see roster.Group.Join)
+func SetEnrollment(g *roster.Group, invite bool) {
+	defaultGroup, defaultEnrollment = g, tern(invite, inviting, joining)
+}
+
+// greet exchanges the device hellos over the session identified by binding,
+// returning the device of the peer if there is a group to authenticate it against
+func greet(conn net.Conn, g *roster.Group, enroll enrollment, binding []byte, initiator bool) (*roster.Device, error) {
+	hello := func() *roster.Hello {
+		if g == nil {
+			return &roster.Hello{}
+		}
+		return g.Hello(binding)
+	}
+	accept := func(h *roster.Hello) (*roster.Device, error) {
+		if g == nil {
+			if h.Refusal != "" {
+				return nil, fmt.Errorf("refused by peer: %s", h.Refusal)
+			}
+			return nil, nil
+		}
+		accept := g.Accept
+		switch enroll {
+		case inviting:
+			accept = g.Enroll
+		case joining:
+			accept = g.Join
+		}
+		peer, err := accept(binding, h)
+		if err != nil {
+			return nil, err
+		}
+		if defaultLogger != nil {
+			defaultLogger.Infof("connected to device %s", peer.Name)
+		}
+		return peer, nil
+	}
+
+	// The joining device presents first, so that the roster it gets back has the endorsement of it
+	first := initiator
+	if enroll != notEnrolling {
+		first = enroll == joining
+	}
+	if first {
+		if err := writeFrame(conn, hello(), "device hello"); err != nil {
+			return nil, err
+		}
+		h, err := readFrame[roster.Hello](conn, "device hello")
+		if err != nil {
+			return nil, err
+		}
+		return accept(h)
+	}
+	h, err := readFrame[roster.Hello](conn, "device hello")
+	if err != nil {
+		return nil, err
+	}
+	peer, err := accept(h)
+	if err != nil {
+		_ = writeFrame(conn, &roster.Hello{Refusal: err.Error()}, "device hello")
+		return nil, err
+	}
+	return peer, writeFrame(conn, hello(), "device hello")
+}
+
+func writeFrame(conn net.Conn, v any, what string) error {
+	b, _ := json.Marshal(v)
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...)); err != nil {
+		return fmt.Errorf("error sending %s: %w", what, err)
+	}
+	return nil
+}
+
+func readFrame[T any](conn net.Conn, what string) (*T, error) {
+	var n uint32
+	if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+		return nil, fmt.Errorf("error receiving %s: %w", what, err)
+	}
+	if n > maxFrameLen {
+		return nil, fmt.Errorf("%s too large (%d bytes)", what, n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, fmt.Errorf("error receiving %s: %w", what, err)
+	}
+	v := new(T)
+	if err := json.Unmarshal(b, v); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", what, err)
+	}
+	return v, nil
+}
+
+// handshake returns the keys for sending and receiving, and the handshake hash to bind the session.
+// The initiator uses the first of psks, while the responder takes any of them.
+func handshake(conn net.Conn, psks [][]byte, initiator bool) (tx, rx, binding []byte, err error) {
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	header := append([]byte(handshakeMagic), handshakeVersion)
+	newState := func(psk []byte) *symmetricState {
+		s := newSymmetricState(header) // the version is bound as the prologue
+		s.mixKeyAndHash(psk)           // psk0
+		return s
+	}
+	var s *symmetricState
+	var re *ecdh.PublicKey
+	writeMsg := func() error {
+		s.mixHash(e.PublicKey().Bytes())
+		s.mixKey(e.PublicKey().Bytes())
+		if !initiator {
+			if err := s.mixDH(e, re); err != nil {
+				return err
+			}
+		}
+		_, err := conn.Write(slices.Concat(header, e.PublicKey().Bytes(), s.encryptAndHash(nil)))
+		return err
+	}
+	readMsg := func() error {
+		msg := make([]byte, handshakeHeader+noiseKeyLen+chacha20poly1305.Overhead)
+		if _, err := io.ReadFull(conn, msg[:handshakeHeader]); err != nil {
+			return fmt.Errorf("%w: %v (the peer might run an older version of acp)", ErrHandshake, err)
+		}
+		if string(msg[:len(handshakeMagic)]) != handshakeMagic {
+			return fmt.Errorf("%w: the peer runs an older version of acp, upgrade it", ErrHandshake)
+		}
+		if v := msg[len(handshakeMagic)]; v != handshakeVersion {
+			return fmt.Errorf("%w: the peer speaks version %d instead of %d, upgrade the older one", ErrHandshake, v, handshakeVersion)
+		}
+		if _, err := io.ReadFull(conn, msg[handshakeHeader:]); err != nil {
+			return fmt.Errorf("%w: %v", ErrHandshake, err)
+		}
+		var err error
+		if re, err = ecdh.X25519().NewPublicKey(msg[handshakeHeader : handshakeHeader+noiseKeyLen]); err != nil {
+			return fmt.Errorf("%w: %v", ErrHandshake, err)
+		}
+		open := func(s *symmetricState) error {
+			s.mixHash(re.Bytes())
+			s.mixKey(re.Bytes())
+			if initiator {
+				if err := s.mixDH(e, re); err != nil {
+					return err
+				}
+			}
+			if _, err := s.decryptAndHash(msg[handshakeHeader+noiseKeyLen:]); err != nil {
+				return fmt.Errorf("%w: the peer does not have the same PSK", ErrHandshake)
+			}
+			return nil
+		}
+		if initiator {
+			return open(s)
+		}
+		// Try each key on the first message
+		for _, psk := range psks {
+			if s = newState(psk); open(s) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: the peer does not have the same PSK", ErrHandshake)
+	}
+
+	if initiator {
+		s = newState(psks[0])
+		if err = writeMsg(); err == nil {
+			err = readMsg()
+		}
+	} else {
+		if err = readMsg(); err == nil {
+			err = writeMsg()
+		}
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	k1, k2 := s.split()
+	if initiator {
+		return k1, k2, s.h, nil
+	}
+	return k2, k1, s.h, nil
+}
+
+// symmetricState follows the SymmetricState of the Noise specification
+type symmetricState struct {
+	ck, h []byte
+	k     []byte // nil before the first key is mixed in
+	n     uint64
+}
+
+func newSymmetricState(prologue []byte) *symmetricState {
+	h := sha256.Sum256([]byte(noiseProtocol)) // the name is longer than the hash
+	s := &symmetricState{ck: h[:], h: h[:]}
+	s.mixHash(prologue)
+	return s
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.h)
+	h.Write(data)
+	s.h = h.Sum(nil)
+}
+
+// Noise's HKDF is RFC 5869 HKDF with the chaining key as the salt and an empty info
+func (s *symmetricState) hkdf(ikm []byte, n int) []byte {
+	out, _ := hkdf.Key(sha256.New, ikm, s.ck, "", n*sha256.Size)
+	return out
+}
+
+func (s *symmetricState) mixKey(ikm []byte) {
+	out := s.hkdf(ikm, 2)
+	s.ck, s.k, s.n = out[:32], out[32:64], 0
+}
+
+func (s *symmetricState) mixKeyAndHash(ikm []byte) {
+	out := s.hkdf(ikm, 3)
+	s.ck = out[:32]
+	s.mixHash(out[32:64])
+	s.k, s.n = out[64:96], 0
+}
+
+func (s *symmetricState) mixDH(e *ecdh.PrivateKey, re *ecdh.PublicKey) error {
+	shared, err := e.ECDH(re)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrHandshake, err)
+	}
+	s.mixKey(shared)
+	return nil
+}
+
+func (s *symmetricState) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], s.n)
+	s.n++
+	return nonce
+}
+
+func (s *symmetricState) encryptAndHash(plaintext []byte) []byte {
+	c, _ := chacha20poly1305.New(s.k)
+	ciphertext := c.Seal(nil, s.nonce(), plaintext, s.h)
+	s.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	c, _ := chacha20poly1305.New(s.k)
+	plaintext, err := c.Open(nil, s.nonce(), ciphertext, s.h)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+func (s *symmetricState) split() (k1, k2 []byte) {
+	out, _ := hkdf.Key(sha256.New, nil, s.ck, "", 2*sha256.Size)
+	return out[:32], out[32:]
 }
@@ -0,0 +1,244 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	aead "github.com/shadowsocks/go-shadowsocks2/shadowaead"
+
+	"github.com/contextualist/acp/pkg/pnet"
+	"github.com/contextualist/acp/pkg/roster"
+)
+
+func TestEncrypted(t *testing.T) {
+	psk := bytes.Repeat([]byte{1}, 32)
+	ca, cb := net.Pipe()
+	data := bytes.Repeat([]byte("acp"), 100000)
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	chResult := make(chan result)
+	go func() {
+		conn, err := encrypted(cb, [][]byte{psk}, false)
+		chResult <- result{conn, err}
+	}()
+	sender, err := encrypted(ca, [][]byte{psk}, true)
+	if err != nil {
+		t.Fatalf("sender handshake: %v", err)
+	}
+	r := <-chResult
+	if r.err != nil {
+		t.Fatalf("receiver handshake: %v", r.err)
+	}
+	go func() {
+		_, _ = sender.Write(data)
+		_ = sender.Close()
+	}()
+	got, _ := io.ReadAll(r.conn)
+	if !bytes.Equal(got, data) {
+		t.Fatalf("data corrupted: got %d bytes, expect %d", len(got), len(data))
+	}
+}
+
+func TestAuthenticated(t *testing.T) {
+	psk := bytes.Repeat([]byte{1}, 32)
+	for _, c := range []struct {
+		name string
+		peer []byte
+		ok   bool
+	}{
+		{"same PSK", psk, true},
+		{"wrong PSK", bytes.Repeat([]byte{2}, 32), false},
+	} {
+		ca, cb := net.Pipe()
+		chErr := make(chan error)
+		go func() {
+			conn, err := authenticated(cb, [][]byte{psk}, false)
+			if err == nil {
+				_, err = conn.Write([]byte("acp"))
+				_ = conn.Close()
+			}
+			chErr <- err
+		}()
+		conn, err := authenticated(ca, [][]byte{c.peer}, true)
+		if err == nil {
+			var got []byte
+			got, err = io.ReadAll(conn)
+			if err == nil && string(got) != "acp" {
+				t.Errorf("%s: data corrupted: %q", c.name, got)
+			}
+			_ = conn.Close()
+		}
+		errPeer := <-chErr
+		if (err == nil && errPeer == nil) != c.ok {
+			t.Errorf("%s: unexpected result: %v, %v", c.name, err, errPeer)
+		}
+	}
+}
+
+func TestEncryptedSessionKeys(t *testing.T) {
+	psk := bytes.Repeat([]byte{1}, 32)
+	var keys [][]byte
+	for range 2 {
+		ca, cb := net.Pipe()
+		chKeys := make(chan [2][]byte)
+		go func() {
+			tx, rx, _, _ := handshake(cb, [][]byte{psk}, false)
+			chKeys <- [2][]byte{tx, rx}
+		}()
+		tx, rx, _, err := handshake(ca, [][]byte{psk}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer := <-chKeys
+		if !bytes.Equal(tx, peer[1]) || !bytes.Equal(rx, peer[0]) || bytes.Equal(tx, rx) {
+			t.Fatalf("mismatched keys")
+		}
+		keys = append(keys, tx)
+	}
+	if bytes.Equal(keys[0], keys[1]) {
+		t.Fatalf("session keys reused")
+	}
+}
+
+func TestEncryptedMismatch(t *testing.T) {
+	psk := bytes.Repeat([]byte{1}, 32)
+	for _, c := range []struct {
+		name   string
+		peer   func(net.Conn)
+		expect string
+	}{
+		{"wrong PSK", func(conn net.Conn) {
+			_, _ = encrypted(conn, [][]byte{bytes.Repeat([]byte{2}, 32)}, true)
+		}, "same PSK"},
+		{"legacy", func(conn net.Conn) {
+			cipher, _ := aead.Chacha20Poly1305(psk)
+			_, _ = aead.NewConn(conn, cipher).Write([]byte("hello"))
+		}, "older version"},
+		{"newer version", func(conn net.Conn) {
+			_, _ = conn.Write([]byte(handshakeMagic + "\x06" + strings.Repeat("\x00", noiseKeyLen+16)))
+		}, "version 6"},
+	} {
+		ca, cb := net.Pipe()
+		go c.peer(ca)
+		_, err := encrypted(cb, [][]byte{psk}, false)
+		if !errors.Is(err, ErrHandshake) || !strings.Contains(err.Error(), c.expect) {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+		_ = ca.Close()
+	}
+}
+
+func TestEncryptedDevices(t *testing.T) {
+	open := func() *roster.Group {
+		g, err := roster.Open(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return g
+	}
+	ga, gb, gc := open(), open(), open()
+	binding := []byte("session")
+	greetBoth := func(ga, gb *roster.Group, enrollA, enrollB enrollment) (errA, errB error) {
+		ca, cb := net.Pipe()
+		defer ca.Close()
+		defer cb.Close()
+		chErr := make(chan error)
+		go func() {
+			_, err := greet(cb, gb, enrollB, binding, false)
+			chErr <- err
+		}()
+		_, errA = greet(ca, ga, enrollA, binding, true)
+		return errA, <-chErr
+	}
+
+	// New devices, as if set up before the roster, take in the first peer
+	if errA, errB := greetBoth(ga, gb, notEnrolling, notEnrolling); errA != nil || errB != nil {
+		t.Fatalf("new devices rejected: %v, %v", errA, errB)
+	}
+	if errA, errB := greetBoth(gc, ga, notEnrolling, notEnrolling); errA == nil || errB == nil {
+		t.Fatalf("devices accepted without enrollment")
+	}
+	if errA, errB := greetBoth(ga, gc, inviting, joining); errA != nil || errB != nil {
+		t.Fatalf("devices rejected: %v, %v", errA, errB)
+	}
+	if len(ga.Roster().Devices) != 3 || len(gc.Roster().Devices) != 3 {
+		t.Fatalf("devices not enrolled: %+v, %+v", ga.Roster(), gc.Roster())
+	}
+	if errA, errB := greetBoth(ga, gc, notEnrolling, notEnrolling); errA != nil || errB != nil {
+		t.Fatalf("devices rejected: %v, %v", errA, errB)
+	}
+	if errA, errB := greetBoth(nil, gc, notEnrolling, notEnrolling); errA == nil || errB == nil {
+		t.Errorf("peer without a device key accepted")
+	}
+
+	// c revokes a, as named in the roster c has taken
+	for _, d := range gc.Roster().Devices {
+		if d.Key.Equal(ga.Self.Key) {
+			if err := gc.Revoke(d.Name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	errA, errB := greetBoth(ga, gc, notEnrolling, notEnrolling)
+	if errB == nil || errA == nil || !strings.Contains(errA.Error(), "refused by peer") {
+		t.Errorf("revoked device accepted: %v, %v", errA, errB)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	rotated, behind := keyring{psk: newKey, prev: oldKey}, keyring{psk: oldKey}
+	done := keyring{psk: newKey} // after the grace period
+	for _, c := range []struct {
+		name           string
+		initiator, res keyring
+		ok             bool
+	}{
+		{"rotated to behind", rotated, behind, true},
+		{"behind to rotated", behind, rotated, true},
+		{"rotated to rotated", rotated, rotated, true},
+		{"done to rotated", done, rotated, true},
+		{"rotated to done", rotated, done, false}, // the channel is no longer shared anyway
+		{"behind to done", behind, done, false},
+	} {
+		ca, cb := net.Pipe()
+		chErr := make(chan error)
+		go func() {
+			_, _, _, err := handshake(cb, c.res.session(&pnet.PeerInfo{}, false), false)
+			_ = cb.Close()
+			chErr <- err
+		}()
+		_, _, _, err := handshake(ca, c.initiator.session(&pnet.PeerInfo{}, true), true)
+		errRes := <-chErr
+		if (err == nil && errRes == nil) != c.ok {
+			t.Errorf("%s: unexpected result: %v, %v", c.name, err, errRes)
+		}
+		_ = ca.Close()
+	}
+}
+
+func TestHandOver(t *testing.T) {
+	r := &KeyRotation{PSK: []byte("new psk"), Until: 1}
+	for _, initiator := range []bool{true, false} {
+		ca, cb := net.Pipe()
+		var got *KeyRotation
+		chErr := make(chan error)
+		go func() {
+			chErr <- handOver(cb, nil, func(r *KeyRotation) { got = r }, !initiator)
+		}()
+		err := handOver(ca, r, func(*KeyRotation) { t.Errorf("nothing to pick up") }, initiator)
+		if err = errors.Join(err, <-chErr); err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || string(got.PSK) != "new psk" || got.Until != 1 {
+			t.Errorf("rotation not handed over: %+v", got)
+		}
+		_ = ca.Close()
+	}
+}
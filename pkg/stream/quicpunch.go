@@ -0,0 +1,324 @@
+package stream
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/contextualist/acp/pkg/config"
+	"github.com/contextualist/acp/pkg/pnet"
+)
+
+func init() {
+	registerDialer("quic_punch", &QUICHolePunch{})
+}
+
+const (
+	quicALPN             = "acp"
+	quicPunchTimeout     = 5 * time.Second
+	quicProbeInterval    = 200 * time.Millisecond
+	quicLingerTimeout    = 2 * time.Second
+	quicPunchProbePrefix = "acp-punch"
+)
+
+type QUICHolePunch struct {
+	keys keyring
+	// Whether to use IPv6 instead of IPv4 for rendezvous
+	useIPv6 bool
+	// Abort the transfer if the peer is silent for this long
+	idleTimeout time.Duration
+	// The UDP socket for both STUN and QUIC, bound at the first configured port
+	pconn net.PacketConn
+	// Candidate endpoints of pconn to be advertised, complete once chSTUN is closed
+	addrs  []string
+	chSTUN chan struct{}
+	// QUIC over pconn, set up after STUN as it takes over reading from pconn
+	tr     *quic.Transport
+	trOnce sync.Once
+}
+
+func (d *QUICHolePunch) Init(conf config.Config) (err error) {
+	if pnet.Proxied() {
+		return errProxied
+	}
+	if d.keys, err = newKeyring(conf); err != nil {
+		return err
+	}
+	d.useIPv6 = conf.UseIPv6
+	d.idleTimeout = time.Duration(conf.IdleTimeout) * time.Second
+
+	network := tern(d.useIPv6, "udp6", "udp4")
+	d.pconn, err = pnet.ListenPacket(context.TODO(), network, fmt.Sprintf(":%d", conf.Ports[0]))
+	if err != nil {
+		defaultLogger.Debugf("failed to listen on UDP port %d: %v", conf.Ports[0], err)
+		return ErrNotAvailable
+	}
+	port := d.pconn.LocalAddr().(*net.UDPAddr).Port
+	if ip, err := pnet.OutboundIP(d.useIPv6); err == nil {
+		d.addrs = append(d.addrs, net.JoinHostPort(ip.String(), fmt.Sprint(port)))
+	} else {
+		defaultLogger.Debugf("%v", err)
+	}
+	// Not to hold up the other dialers, the public endpoint is looked up in the background until SetInfo
+	d.chSTUN = make(chan struct{})
+	go d.lookUpPublic(conf.STUNServers)
+	return nil
+}
+
+// lookUpPublic finds the public endpoint of pconn from the first STUN server responding
+func (d *QUICHolePunch) lookUpPublic(servers []string) {
+	defer close(d.chSTUN)
+	for _, server := range servers {
+		pub, err := pnet.STUNMappedAddr(context.TODO(), d.pconn, server, d.useIPv6)
+		if err != nil {
+			defaultLogger.Debugf("STUN: %v", err)
+			continue
+		}
+		if pubStr := pub.String(); len(d.addrs) == 0 || d.addrs[0] != pubStr {
+			d.addrs = append(d.addrs, pubStr)
+		}
+		return
+	}
+}
+
+func (d *QUICHolePunch) SetInfo(info *pnet.SelfInfo) {
+	<-d.chSTUN
+	if len(d.addrs) == 0 {
+		defaultLogger.Debugf("no UDP endpoint to advertise")
+		return
+	}
+	defaultLogger.Debugf("UDP endpoints: %v", d.addrs)
+	info.UDPAddrs = d.addrs
+}
+
+func (d *QUICHolePunch) IntoSender(ctx context.Context, info pnet.PeerInfo) (io.WriteCloser, error) {
+	conn, err := d.holePunching(ctx, info, true)
+	if err != nil {
+		return nil, err
+	}
+	if conn, err = encrypted(conn, d.keys.session(&info, true), true); err != nil {
+		return nil, err
+	}
+	return senderStream(conn, &info, d.idleTimeout), nil
+}
+
+func (d *QUICHolePunch) IntoReceiver(ctx context.Context, info pnet.PeerInfo) (io.ReadCloser, error) {
+	conn, err := d.holePunching(ctx, info, false)
+	if err != nil {
+		return nil, err
+	}
+	if conn, err = encrypted(conn, d.keys.session(&info, false), false); err != nil {
+		return nil, err
+	}
+	return receiverStream(conn, &info, d.idleTimeout), nil
+}
+
+// holePunching opens the NAT mappings on both ends with UDP probes, while establishing a
+// QUIC connection over the same socket. The sender acts as the QUIC client.
+func (d *QUICHolePunch) holePunching(ctx context.Context, info pnet.PeerInfo, isClient bool) (net.Conn, error) {
+	if len(info.UDPAddrs) == 0 {
+		return nil, errors.New("peer does not advertise any UDP endpoint")
+	}
+	var peerAddrs []*net.UDPAddr
+	for _, a := range info.UDPAddrs {
+		ua, err := net.ResolveUDPAddr(tern(d.useIPv6, "udp6", "udp4"), a)
+		if err != nil {
+			defaultLogger.Debugf("skip peer UDP endpoint %s: %v", a, err)
+			continue
+		}
+		peerAddrs = append(peerAddrs, ua)
+	}
+	defaultLogger.Infof("QUIC rendezvous with %s", strings.Join(info.UDPAddrs, " | "))
+
+	ctx, cancel := context.WithTimeout(ctx, quicPunchTimeout)
+	defer cancel()
+	tr := d.transport()
+	go probe(ctx, tr, peerAddrs)
+
+	quicConf := &quic.Config{
+		HandshakeIdleTimeout: quicPunchTimeout,
+		MaxIdleTimeout:       d.idleTimeout,
+		KeepAlivePeriod:      d.idleTimeout / 4,
+	}
+	tlsConf, err := quicTLSConfig(d.keys.channel(&info))
+	if err != nil {
+		return nil, err
+	}
+	var qconn *quic.Conn
+	if isClient {
+		qconn, err = dialFirst(ctx, tr, peerAddrs, tlsConf, quicConf)
+	} else {
+		qconn, err = acceptPeer(ctx, tr, tlsConf, quicConf)
+	}
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			defaultLogger.Infof("QUIC rendezvous timeout for %v -> %v", d.addrs, info.UDPAddrs)
+		}
+		return nil, err
+	}
+	defaultLogger.Debugf("QUIC connected %v->%v", qconn.LocalAddr(), qconn.RemoteAddr())
+
+	var stream *quic.Stream
+	if isClient {
+		stream, err = qconn.OpenStreamSync(ctx)
+	} else {
+		// The stream shows up on the first write, i.e., the handshake right away, so it is bounded as the punch
+		stream, err = qconn.AcceptStream(ctx)
+	}
+	if err != nil {
+		_ = qconn.CloseWithError(0, "")
+		return nil, fmt.Errorf("failed to open QUIC stream: %w", err)
+	}
+	return &quicStreamConn{Stream: stream, conn: qconn, linger: !isClient}, nil
+}
+
+// transport returns the QUIC transport over pconn, shared by all attempts
+func (d *QUICHolePunch) transport() *quic.Transport {
+	d.trOnce.Do(func() {
+		<-d.chSTUN
+		d.tr = &quic.Transport{Conn: d.pconn}
+	})
+	return d.tr
+}
+
+// Close shuts down the QUIC transport along with the socket
+func (d *QUICHolePunch) Close() error {
+	<-d.chSTUN
+	if d.tr != nil {
+		_ = d.tr.Close() // does not close pconn, which it did not create
+	}
+	return d.pconn.Close()
+}
+
+// probe keeps sending packets to all peer endpoints, so that our NAT lets through the peer's packets
+func probe(ctx context.Context, tr *quic.Transport, peerAddrs []*net.UDPAddr) {
+	for {
+		for _, a := range peerAddrs {
+			_, _ = tr.WriteTo([]byte(quicPunchProbePrefix), a)
+		}
+		select {
+		case <-time.After(quicProbeInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func dialFirst(ctx context.Context, tr *quic.Transport, peerAddrs []*net.UDPAddr, tlsConf *tls.Config, quicConf *quic.Config) (*quic.Conn, error) {
+	type result struct {
+		conn *quic.Conn
+		err  error
+	}
+	chResult := make(chan result, len(peerAddrs))
+	for _, a := range peerAddrs {
+		go func() {
+			c, err := tr.Dial(ctx, a, tlsConf, quicConf)
+			chResult <- result{c, err}
+		}()
+	}
+	var errs []error
+	for n := range len(peerAddrs) {
+		r := <-chResult
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		go func() { // close the redundant connections, if any
+			for range len(peerAddrs) - n - 1 {
+				if r := <-chResult; r.err == nil {
+					_ = r.conn.CloseWithError(0, "")
+				}
+			}
+		}()
+		return r.conn, nil
+	}
+	return nil, fmt.Errorf("QUIC dial failed: %w", errors.Join(errs...))
+}
+
+// acceptPeer waits for the peer to connect. Connections not presenting the identity of the
+// group never complete the handshake, so a stranger reaching the socket first cannot take the slot.
+func acceptPeer(ctx context.Context, tr *quic.Transport, tlsConf *tls.Config, quicConf *quic.Config) (*quic.Conn, error) {
+	ln, err := tr.Listen(tlsConf, quicConf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for QUIC: %w", err)
+	}
+	// Closing the listener does not affect accepted connections
+	defer func() { _ = ln.Close() }()
+	return ln.Accept(ctx)
+}
+
+// quicTLSConfig sets up mutual TLS with an identity derived from the PSK, which both ends pin.
+// It only keeps strangers out of the QUIC connection, as the peer is authenticated by the layer on top.
+func quicTLSConfig(psk []byte) (*tls.Config, error) {
+	seed, _ := hkdf.Key(sha256.New, psk, nil, "acp quic identity", ed25519.SeedSize)
+	priv := ed25519.NewKeyFromSeed(seed)
+	pub := priv.Public().(ed25519.PublicKey)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate: %w", err)
+	}
+	pinned := func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no certificate from the peer")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if key, ok := cert.PublicKey.(ed25519.PublicKey); !ok || !key.Equal(pub) {
+			return errors.New("the peer does not hold the PSK")
+		}
+		return nil
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+		ClientAuth:   tls.RequireAnyClientCert,
+		// The chain is self-signed, so the key is checked against the pinned one instead
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: pinned,
+		NextProtos:            []string{quicALPN},
+	}, nil
+}
+
+// quicStreamConn adapts a QUIC stream into a net.Conn
+type quicStreamConn struct {
+	*quic.Stream
+	conn *quic.Conn
+	// Whether to wait for the peer to close the connection first, so that
+	// the last bytes we wrote are not cut off
+	linger bool
+}
+
+func (c *quicStreamConn) Close() error {
+	err := c.Stream.Close()
+	if c.linger {
+		select {
+		case <-c.conn.Context().Done():
+		case <-time.After(quicLingerTimeout):
+		}
+	}
+	_ = c.conn.CloseWithError(0, "")
+	return err
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *quicStreamConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
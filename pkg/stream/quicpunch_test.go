@@ -0,0 +1,91 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/contextualist/acp/pkg/pnet"
+)
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Infof(format string, a ...any)  { l.t.Logf(format, a...) }
+func (l testLogger) Debugf(format string, a ...any) { l.t.Logf(format, a...) }
+
+func newLoopbackQUIC(t *testing.T, psk []byte) *QUICHolePunch {
+	pconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &QUICHolePunch{
+		keys:        keyring{psk: psk},
+		idleTimeout: 5 * time.Second,
+		pconn:       pconn,
+		addrs:       []string{pconn.LocalAddr().String()},
+		chSTUN:      make(chan struct{}),
+	}
+	close(d.chSTUN)
+	t.Cleanup(func() { _ = d.Close() })
+	return d
+}
+
+func TestQUICPunch(t *testing.T) {
+	SetLogger(testLogger{t})
+	t.Cleanup(func() { SetLogger(nil) })
+	psk := bytes.Repeat([]byte{1}, 32)
+	a, b := newLoopbackQUIC(t, psk), newLoopbackQUIC(t, psk)
+	stranger := newLoopbackQUIC(t, bytes.Repeat([]byte{2}, 32))
+	ctx := context.Background()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	chResult := make(chan result, 1)
+	go func() {
+		conn, err := a.holePunching(ctx, pnet.PeerInfo{UDPAddrs: b.addrs}, false)
+		chResult <- result{conn, err}
+	}()
+
+	// Reaching the socket first does not take the place of the peer
+	if conn, err := stranger.holePunching(ctx, pnet.PeerInfo{UDPAddrs: a.addrs}, true); err == nil {
+		_ = conn.Close()
+		t.Fatal("connection from a stranger should be rejected")
+	}
+
+	conn, err := b.holePunching(ctx, pnet.PeerInfo{UDPAddrs: a.addrs}, true)
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	data := bytes.Repeat([]byte("acp"), 10000)
+	chErr := make(chan error, 1)
+	go func() {
+		if _, err := conn.Write(data); err != nil {
+			chErr <- err
+			return
+		}
+		_, err := io.ReadFull(conn, make([]byte, 2)) // wait for the receipt before hanging up
+		_ = conn.Close()
+		chErr <- err
+	}()
+	r := <-chResult
+	if r.err != nil {
+		t.Fatalf("server: %v", r.err)
+	}
+	got := make([]byte, len(data))
+	if _, err = io.ReadFull(r.conn, got); err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	_, _ = r.conn.Write([]byte("ok"))
+	_ = r.conn.Close()
+	if err = <-chErr; err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data corrupted")
+	}
+}
@@ -0,0 +1,97 @@
+package stream
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/contextualist/acp/pkg/config"
+	"github.com/contextualist/acp/pkg/pnet"
+	"github.com/contextualist/acp/pkg/relay"
+)
+
+func init() {
+	registerDialer("relay", &Relay{})
+}
+
+const (
+	relayNonceLen = 12
+	relayTimeout  = 30 * time.Second
+)
+
+type Relay struct {
+	relayURL string
+	keys     keyring
+	// Abort the transfer if the peer is silent for this long
+	idleTimeout time.Duration
+	// Our half of the material for the relay channel token
+	nonce string
+}
+
+func (d *Relay) Init(conf config.Config) (err error) {
+	if d.keys, err = newKeyring(conf); err != nil {
+		return err
+	}
+	// Not every rendezvous server hosts a relay (e.g. the one on Deno), so there is no default
+	if d.relayURL = conf.Relay; d.relayURL == "" {
+		return fmt.Errorf("%w: no relay is configured, set relay in the config", ErrNotAvailable)
+	}
+	d.idleTimeout = time.Duration(conf.IdleTimeout) * time.Second
+	nonce := make([]byte, relayNonceLen)
+	_, _ = rand.Read(nonce)
+	d.nonce = base64.StdEncoding.EncodeToString(nonce)
+	return nil
+}
+
+func (d *Relay) SetInfo(info *pnet.SelfInfo) {
+	info.RelayNonce = d.nonce
+}
+
+func (d *Relay) IntoSender(ctx context.Context, info pnet.PeerInfo) (io.WriteCloser, error) {
+	conn, err := d.dial(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	if conn, err = encrypted(conn, d.keys.session(&info, true), true); err != nil {
+		return nil, err
+	}
+	return senderStream(conn, &info, d.idleTimeout), nil
+}
+
+func (d *Relay) IntoReceiver(ctx context.Context, info pnet.PeerInfo) (io.ReadCloser, error) {
+	conn, err := d.dial(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	if conn, err = encrypted(conn, d.keys.session(&info, false), false); err != nil {
+		return nil, err
+	}
+	return receiverStream(conn, &info, d.idleTimeout), nil
+}
+
+func (d *Relay) dial(ctx context.Context, info pnet.PeerInfo) (net.Conn, error) {
+	if info.RelayNonce == "" {
+		return nil, errors.New("peer does not support relay")
+	}
+	defaultLogger.Infof("connecting via relay %s", d.relayURL)
+	ctx, cancel := context.WithTimeout(ctx, relayTimeout)
+	defer cancel()
+	return relay.Dial(ctx, d.relayURL, d.channelToken(&info), pnet.DialUpstream)
+}
+
+// channelToken derives the relay channel from both nonces, so that it is unique for this session
+// and cannot be guessed by anyone without the PSK
+func (d *Relay) channelToken(info *pnet.PeerInfo) string {
+	mac := hmac.New(sha256.New, d.keys.channel(info))
+	mac.Write([]byte("acp relay channel|"))
+	mac.Write([]byte(min(d.nonce, info.RelayNonce) + "|" + max(d.nonce, info.RelayNonce)))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
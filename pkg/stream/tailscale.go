@@ -5,12 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/netip"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 
@@ -28,6 +30,8 @@ type TSCapability uint
 const (
 	TSTaildrop TSCapability = 1 << iota
 	TSTun
+	// Tun streams may go unencrypted after authentication, as WireGuard encrypts them anyway
+	TSAuthOnly
 )
 
 type Tailscale struct {
@@ -46,6 +50,9 @@ func (d *Tailscale) Init(conf config.Config) error {
 	if d.capability == 0 {
 		return ErrNotAvailable
 	}
+	if d.capability&TSTun != 0 && conf.TailscaleAuthOnly {
+		d.capability |= TSAuthOnly
+	}
 	return nil
 }
 
@@ -88,7 +95,10 @@ func (d *Tailscale) pickImpl(cap1, cap2 TSCapability) (Dialer, error) {
 }
 
 type tailscaleTun struct {
-	laddr string
+	laddr       string
+	idleTimeout time.Duration
+	keys        keyring
+	authOnly    bool
 }
 
 func (d *tailscaleTun) Init(conf config.Config) error {
@@ -105,6 +115,11 @@ func (d *tailscaleTun) Init(conf config.Config) error {
 	}
 	d.laddr = listener.Addr().String()
 	_ = listener.Close()
+	if d.keys, err = newKeyring(conf); err != nil {
+		return err
+	}
+	d.authOnly = conf.TailscaleAuthOnly
+	d.idleTimeout = time.Duration(conf.IdleTimeout) * time.Second
 	defaultLogger.Debugf("tailscale IP address is available")
 	return nil
 }
@@ -114,11 +129,32 @@ func (d *tailscaleTun) SetInfo(info *pnet.SelfInfo) {
 }
 
 func (d *tailscaleTun) IntoSender(ctx context.Context, info pnet.PeerInfo) (io.WriteCloser, error) {
-	return pnet.RendezvousWithTimeout(ctx, d.laddr, []pnet.AddrPair{{PriAddr: info.TSAddr, PubAddr: info.TSAddr}})
+	conn, err := d.connect(ctx, info, true)
+	if err != nil {
+		return nil, err
+	}
+	return senderStream(conn, &info, d.idleTimeout), nil
 }
 
 func (d *tailscaleTun) IntoReceiver(ctx context.Context, info pnet.PeerInfo) (io.ReadCloser, error) {
-	return pnet.RendezvousWithTimeout(ctx, d.laddr, []pnet.AddrPair{{PriAddr: info.TSAddr, PubAddr: info.TSAddr}})
+	conn, err := d.connect(ctx, info, false)
+	if err != nil {
+		return nil, err
+	}
+	return receiverStream(conn, &info, d.idleTimeout), nil
+}
+
+// connect authenticates the peer as any other dialer does, since every node on the tailnet (shared ones
+// included) could reach our address during the rendezvous. The encryption is skipped if both ends agree to.
+func (d *tailscaleTun) connect(ctx context.Context, info pnet.PeerInfo, initiator bool) (net.Conn, error) {
+	conn, err := pnet.RendezvousWithTimeout(ctx, d.laddr, []pnet.AddrPair{{PriAddr: info.TSAddr, PubAddr: info.TSAddr}})
+	if err != nil {
+		return nil, err
+	}
+	if d.authOnly && TSCapability(info.TSCap)&TSAuthOnly != 0 {
+		return authenticated(conn, d.keys.session(&info, initiator), initiator)
+	}
+	return encrypted(conn, d.keys.session(&info, initiator), initiator)
 }
 
 type taildrop struct {
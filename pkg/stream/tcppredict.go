@@ -0,0 +1,152 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/contextualist/acp/pkg/config"
+	"github.com/contextualist/acp/pkg/pnet"
+)
+
+func init() {
+	registerDialer("tcp_predict", &TcpPortPrediction{})
+}
+
+const (
+	// Number of ports to cover for a NAT allocating sequentially, to tolerate drifts caused
+	// by other connections made in between
+	sprayWindow = 32
+	// Upper limit of sockets opened for a spray, which gives a ~60% chance of collision
+	// for the birthday spray
+	sprayMaxSockets  = 256
+	natSampleTimeout = 5 * time.Second
+)
+
+// TcpPortPrediction is TCP hole punching for symmetric NATs, guessing the public ports
+// that the NATs are going to allocate
+type TcpPortPrediction struct {
+	keys keyring
+	// Whether to prefer IPv6 over IPv4 for rendezvous
+	useIPv6 bool
+	// Abort the transfer if the peer is silent for this long
+	idleTimeout time.Duration
+	// How our NAT allocates ports, known once chSampled is closed
+	nat       *pnet.NATInfo
+	chSampled chan struct{}
+}
+
+func (d *TcpPortPrediction) Init(conf config.Config) (err error) {
+	if pnet.Proxied() {
+		return errProxied
+	}
+	if d.keys, err = newKeyring(conf); err != nil {
+		return err
+	}
+	d.useIPv6 = conf.UseIPv6
+	d.idleTimeout = time.Duration(conf.IdleTimeout) * time.Second
+	d.chSampled = make(chan struct{})
+	go d.sample(conf.Server + "/v2/whoami")
+	return nil
+}
+
+// sample infers the NAT behaviour in the background, which is left unknown if the server cannot tell
+func (d *TcpPortPrediction) sample(whoamiURL string) {
+	defer close(d.chSampled)
+	ctx, cancel := context.WithTimeout(context.Background(), natSampleTimeout)
+	defer cancel()
+	nat, err := pnet.SampleNAT(ctx, whoamiURL, d.useIPv6)
+	if err != nil {
+		defaultLogger.Debugf("%v", err)
+		nat = &pnet.NATInfo{Pattern: pnet.NATUnknown}
+	}
+	d.nat = nat
+}
+
+func (d *TcpPortPrediction) SetInfo(info *pnet.SelfInfo) {
+	<-d.chSampled
+	info.NAT = d.nat
+}
+
+func (d *TcpPortPrediction) IntoSender(ctx context.Context, info pnet.PeerInfo) (io.WriteCloser, error) {
+	conn, err := d.spray(ctx, info, pnet.NominationControlling)
+	if err != nil {
+		return nil, err
+	}
+	if conn, err = encrypted(conn, d.keys.session(&info, true), true); err != nil {
+		return nil, err
+	}
+	return senderStream(conn, &info, d.idleTimeout), nil
+}
+
+func (d *TcpPortPrediction) IntoReceiver(ctx context.Context, info pnet.PeerInfo) (io.ReadCloser, error) {
+	conn, err := d.spray(ctx, info, pnet.NominationControlled)
+	if err != nil {
+		return nil, err
+	}
+	if conn, err = encrypted(conn, d.keys.session(&info, false), false); err != nil {
+		return nil, err
+	}
+	return receiverStream(conn, &info, d.idleTimeout), nil
+}
+
+// spray picks the tactic from the NAT behaviour of both sides. Both sides arrive at
+// complementary tactics, since they see the same pair of NAT info. Of the connections that
+// get through, the sender nominates the one to keep.
+func (d *TcpPortPrediction) spray(ctx context.Context, info pnet.PeerInfo, nomination int) (net.Conn, error) {
+	if info.NAT == nil || len(info.PeerAddrs) == 0 {
+		return nil, errors.New("peer does not report its NAT behaviour")
+	}
+	ours, peer := d.nat, info.NAT
+	unpredictable := func(n *pnet.NATInfo) bool { return n.Pattern == pnet.NATUnknown || n.Pattern == pnet.NATRandom }
+	if (ours.Pattern == pnet.NATUnknown || peer.Pattern == pnet.NATUnknown) && unpredictable(ours) && unpredictable(peer) {
+		return nil, errors.New("the NAT behaviour of one side is unknown, and the ports of neither side can be predicted")
+	}
+	// Otherwise the side of unknown NAT behaviour sprays as if its ports were random
+	ours, peer = unknownAsRandom(ours), unknownAsRandom(peer)
+	if ours.Predictable() && peer.Predictable() {
+		return nil, errors.New("neither side is behind a symmetric NAT; port prediction is not needed")
+	}
+	if ours.Pattern == pnet.NATRandom && peer.Pattern == pnet.NATRandom {
+		defaultLogger.Infof("both sides are behind NATs allocating random ports, which is unlikely to be traversed")
+	}
+	host, portStr, err := net.SplitHostPort(info.PeerAddrs[0].PubAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer address: %w", err)
+	}
+	lastPort, _ := strconv.Atoi(portStr) // the peer's latest mapping, made for the exchange
+
+	// Our attempts, and the peer's public ports to aim at
+	var n int
+	switch {
+	case ours.Predictable(): // reachable at the exchange port, which the peer aims at
+		n = tern(peer.Pattern == pnet.NATSequential, sprayWindow, sprayMaxSockets)
+	case peer.Predictable(): // aim all new mappings at the peer's one port
+		n = tern(ours.Pattern == pnet.NATSequential, sprayWindow, sprayMaxSockets)
+	default: // the i-th of our new mappings meets the i-th of the peer's
+		n = tern(ours.Pattern == pnet.NATSequential && peer.Pattern == pnet.NATSequential, sprayWindow, sprayMaxSockets)
+	}
+	var targets []string
+	for _, p := range pnet.PredictPorts(peer, lastPort, tern(peer.Predictable(), 1, n)) {
+		targets = append(targets, net.JoinHostPort(host, strconv.Itoa(p)))
+	}
+
+	// The exchange might have gone through the family other than the preferred one
+	isIPv6 := strings.Contains(host, ":")
+	if ours.Predictable() {
+		return pnet.Spray(ctx, isIPv6, info.Laddr, n, targets, nomination)
+	}
+	return pnet.Spray(ctx, isIPv6, "", n, targets, nomination)
+}
+
+func unknownAsRandom(n *pnet.NATInfo) *pnet.NATInfo {
+	if n.Pattern == pnet.NATUnknown {
+		return &pnet.NATInfo{Pattern: pnet.NATRandom}
+	}
+	return n
+}
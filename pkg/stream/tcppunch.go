@@ -2,11 +2,14 @@ package stream
 
 import (
 	"context"
-	"encoding/base64"
-	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/contextualist/acp/pkg/config"
 	"github.com/contextualist/acp/pkg/pnet"
@@ -16,33 +19,94 @@ func init() {
 	registerDialer("tcp_punch", &TcpHolePunch{})
 }
 
+const portMappingTimeout = 5 * time.Second
+
 type TcpHolePunch struct {
 	bridgeURL string
 	id        string
-	psk       []byte
-	// Whether to use IPv6 instead of IPv4 for rendezvous
+	keys      keyring
+	// Whether to prefer IPv6 over IPv4 for rendezvous
 	useIPv6 bool
 	// Local port(s) to be used for rendezvous
 	ports []int
-	// Whether to try requesting uPnP port mapping from the router
+	// Whether to try requesting port mapping from the router
 	uPnP bool
+	// Port mapping held on the router, if any
+	mapping *pnet.PortMapping
+	// Addresses of the ports to be advertised, in addition to the ones observed in the exchange,
+	// complete along with the mapping once chProbed is closed
+	candidates []pnet.Candidate
+	chProbed   chan struct{}
+	// Time budget for hole punching in total, and for each pair of local port and peer address
+	rendezvousTimeout, attemptTimeout time.Duration
+	// Abort the transfer if the peer is silent for this long
+	idleTimeout time.Duration
 }
 
 func (d *TcpHolePunch) Init(conf config.Config) (err error) {
+	if pnet.Proxied() {
+		return errProxied
+	}
 	d.bridgeURL = conf.Server + "/v2/exchange"
 	d.id = conf.ID
-	d.psk, err = base64.StdEncoding.DecodeString(conf.PSK)
-	if err != nil {
-		return fmt.Errorf("error decoding PSK: %w", err)
+	if d.keys, err = newKeyring(conf); err != nil {
+		return err
 	}
 	d.useIPv6 = conf.UseIPv6
 	d.ports = conf.Ports
 	d.uPnP = conf.UPnP
+	d.idleTimeout = time.Duration(conf.IdleTimeout) * time.Second
+	d.rendezvousTimeout = time.Duration(conf.RendezvousTimeout * float64(time.Second))
+	d.attemptTimeout = time.Duration(conf.PlanTimeout * float64(time.Second))
+	d.chProbed = make(chan struct{})
+	if d.ports[0] == 0 { // not known until the exchange
+		close(d.chProbed)
+		return nil
+	}
+	go d.probe(conf.Server+"/v2/whoami", conf.ExcludeInterfaces)
 	return nil
 }
 
+// probe maps the ports on the router and gathers the candidates in the background,
+// each bounded by its own timeout
+func (d *TcpHolePunch) probe(whoamiURL string, excludes []string) {
+	defer close(d.chProbed)
+	var mapped []pnet.Candidate
+	var wg sync.WaitGroup
+	if d.uPnP {
+		wg.Go(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), portMappingTimeout)
+			defer cancel()
+			var err error
+			if d.mapping, err = pnet.MapPorts(ctx, d.ports...); err != nil {
+				defaultLogger.Infof("failed to add port mapping: %v", err)
+				return
+			}
+			defaultLogger.Infof("port mapping added: %v", slices.Collect(maps.Values(d.mapping.External)))
+			if ext, ok := d.mapping.External[d.ports[0]]; ok {
+				mapped = append(mapped, pnet.NewCandidate(ext, pnet.CandidateMapped, d.useIPv6))
+			}
+		})
+	}
+	gathered := pnet.GatherCandidates(context.Background(), whoamiURL, d.ports, d.useIPv6, excludes)
+	wg.Wait()
+	d.candidates = append(mapped, gathered...)
+}
+
 func (d *TcpHolePunch) SetInfo(info *pnet.SelfInfo) {
+	<-d.chProbed
 	info.NPlan = len(d.ports)
+	info.Candidates = d.candidates
+	info.Nominate = true
+}
+
+// Close deletes the port mapping, if any
+func (d *TcpHolePunch) Close() error {
+	<-d.chProbed
+	if d.mapping == nil {
+		return nil
+	}
+	return d.mapping.Close()
 }
 
 func (d *TcpHolePunch) IntoSender(ctx context.Context, info pnet.PeerInfo) (io.WriteCloser, error) {
@@ -50,7 +114,10 @@ func (d *TcpHolePunch) IntoSender(ctx context.Context, info pnet.PeerInfo) (io.W
 	if err != nil {
 		return nil, err
 	}
-	return encrypted(conn, d.psk)
+	if conn, err = encrypted(conn, d.keys.session(&info, true), true); err != nil {
+		return nil, err
+	}
+	return senderStream(conn, &info, d.idleTimeout), nil
 }
 
 func (d *TcpHolePunch) IntoReceiver(ctx context.Context, info pnet.PeerInfo) (io.ReadCloser, error) {
@@ -58,40 +125,29 @@ func (d *TcpHolePunch) IntoReceiver(ctx context.Context, info pnet.PeerInfo) (io
 	if err != nil {
 		return nil, err
 	}
-	return encrypted(conn, d.psk)
-}
-
-// HolePunching negotiates via a rendezvous server with a peer with the same id to establish a connection.
-func (d *TcpHolePunch) holePunching(ctx context.Context, info pnet.PeerInfo, isA bool) (conn net.Conn, err error) {
-	if d.uPnP {
-		err = pnet.AddPortMapping(ctx, d.ports...)
-		if err != nil {
-			defaultLogger.Infof("failed to add port mapping: %v", err)
-		}
-	}
-
-	nplan := len(d.ports)
-	if conn, err = pnet.RendezvousWithTimeout(ctx, info.Laddr, info.PeerAddrs); err == nil {
-		return conn, nil
+	if conn, err = encrypted(conn, d.keys.session(&info, false), false); err != nil {
+		return nil, err
 	}
+	return receiverStream(conn, &info, d.idleTimeout), nil
+}
 
-	// Try out the rest of nA x nB plans
-	var planp []int
-	for i := 0; i < tern(isA, nplan, info.PeerNPlan); i++ {
-		for j := 0; j < tern(isA, info.PeerNPlan, nplan); j++ {
-			planp = append(planp, d.ports[tern(isA, i, j)])
-		}
-	}
-	for q := range planp[1:] {
-		info, err := pnet.ExchangeConnInfo(ctx, d.bridgeURL, &pnet.SelfInfo{ChanName: d.id, NPlan: nplan}, q, d.useIPv6)
+// HolePunching establishes a connection with the peer, punching from all our ports towards all
+// candidates of the peer at once. The peer does the same, so that every combination is covered,
+// and the sender nominates the connection to keep.
+func (d *TcpHolePunch) holePunching(ctx context.Context, info pnet.PeerInfo, isA bool) (net.Conn, error) {
+	opts := pnet.RendezvousOptions{Timeout: d.rendezvousTimeout, AttemptTimeout: d.attemptTimeout}
+	laddrs := []string{info.Laddr}
+	if info.Nominate {
+		opts.Nomination = tern(isA, pnet.NominationControlling, pnet.NominationControlled)
+		la, err := netip.ParseAddrPort(info.Laddr)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("invalid local address: %w", err)
 		}
-		if conn, err = pnet.RendezvousWithTimeout(ctx, info.Laddr, info.PeerAddrs); err == nil {
-			return conn, nil
+		for _, p := range d.ports[1:] {
+			laddrs = append(laddrs, netip.AddrPortFrom(la.Addr(), uint16(p)).String())
 		}
-	}
-	return nil, errors.New("all rendezvous attempts failed")
+	} // otherwise, an older peer only punches from its first port, expecting one connection
+	return pnet.RendezvousCandidates(ctx, laddrs, pnet.CandidatesOf(&info, d.useIPv6), opts)
 }
 
 func tern[T any](t bool, a T, b T) T {
@@ -8,7 +8,11 @@ import (
 )
 
 type (
-	logMsg string
+	logMsg     string
+	confirmMsg struct {
+		prompt string
+		answer chan<- bool
+	}
 
 	// A LoggerControl is the user handler for a LoggerModel
 	LoggerControl struct {
@@ -37,6 +41,13 @@ func (c LoggerControl) send(format string, a ...any) {
 	c.ch <- logMsg(fmt.Sprintf(format, a...))
 }
 
+// Confirm shows the prompt below the log entries, and waits for the user to answer yes or no
+func (c LoggerControl) Confirm(prompt string) bool {
+	answer := make(chan bool, 1)
+	c.ch <- confirmMsg{prompt, answer}
+	return <-answer
+}
+
 // Next switch the current model to the next one
 func (c LoggerControl) Next(m tea.Model) {
 	c.ch <- modelSwitchMsg{m}
@@ -48,10 +59,23 @@ func (c LoggerControl) End() {
 	close(c.ch)
 }
 
+// Discard drops all further log entries until End, for when the program has already quit
+func (c LoggerControl) Discard() {
+	go func() {
+		for msg := range c.ch {
+			if msg, ok := msg.(confirmMsg); ok {
+				msg.answer <- false
+			}
+		}
+	}()
+}
+
 // A LoggerModel displays a stream of logs
 type LoggerModel struct {
 	logger LoggerControl
 	logs   []string
+	// The question pending an answer, if any
+	confirm *confirmMsg
 }
 
 func NewLoggerModel(c LoggerControl) tea.Model {
@@ -72,6 +96,9 @@ func (m LoggerModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case logMsg:
 		m.logs = append(m.logs, string(msg))
 		return m, m.waitForLog
+	case confirmMsg:
+		m.confirm = &msg
+		return m, m.waitForLog
 	case modelSwitchMsg:
 		if msg.model == nil {
 			return m, tea.Quit // quit without clearing screen
@@ -80,19 +107,37 @@ func (m LoggerModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case tea.KeyMsg:
 		switch msg.String() {
 		case "ctrl+c":
+			if m.confirm != nil {
+				m.confirm.answer <- false
+			}
 			userCancel()
 			return modelSwitchTo(clearQuitModel{}), nil
 		}
+		if m.confirm != nil {
+			switch msg.String() {
+			case "y", "Y":
+				m.confirm.answer <- true
+			case "n", "N", "enter", "esc":
+				m.confirm.answer <- false
+			default:
+				return m, nil
+			}
+			m.confirm = nil
+		}
 	}
 	return m, nil
 }
 
 func (m LoggerModel) View() string {
+	var prompt string
+	if m.confirm != nil {
+		prompt = m.confirm.prompt + " [y/N] \n"
+	}
 	if m.logger.debug {
-		return strings.Join(m.logs, "\n") + "\n"
+		return strings.Join(m.logs, "\n") + "\n" + prompt
 	}
 	if len(m.logs) == 0 {
-		return ""
+		return prompt
 	}
-	return m.logs[len(m.logs)-1] + "\n"
+	return m.logs[len(m.logs)-1] + "\n" + prompt
 }
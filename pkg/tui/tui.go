@@ -2,6 +2,7 @@ package tui
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 
@@ -26,6 +27,10 @@ func RunProgram(model tea.Model, cancel context.CancelFunc, useStderr bool) tea.
 	programSingleton = tea.NewProgram(model, opts...)
 	userCancel = cancel
 	m, err := programSingleton.Run()
+	if errors.Is(err, tea.ErrInterrupted) { // SIGINT without a TTY
+		cancel()
+		return m
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "BubbleTea: %v", err)
 		os.Exit(1)